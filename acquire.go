@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// confirmAcquisition records the holder and adds the labels showing it holds the lock once the lock has been written
+// to the backend for it, taken from previous unless previous is empty. Obtaining the lock is all or nothing: if the
+// holder can't be recorded or labeled, the backend write is undone so that the lock isn't held by a PR that doesn't
+// show it. The label requesting the lock is left in place for a later run to try again.
+func (lm *LabelMutex) confirmAcquisition(lockValue string, previous string, labels ...string) error {
+	var previousRecord []byte
+	records, ok := lm.records()
+	if ok && previous != "" {
+		value, err := records.GetRecord(lm.holderKey())
+		if err != nil {
+			return lm.rollbackAcquisition(lockValue, previous, nil, err)
+		}
+		previousRecord = value
+	}
+	err := lm.recordHolder()
+	if err == nil {
+		err = lm.addLabels(labels...)
+	}
+	if err != nil {
+		return lm.rollbackAcquisition(lockValue, previous, previousRecord, err)
+	}
+	return nil
+}
+
+// rollbackAcquisition undoes writing the lock to the backend for the holder, handing it back to the holder it was taken
+// from along with that holder's record, or releasing it
+func (lm *LabelMutex) rollbackAcquisition(lockValue string, previous string, previousRecord []byte, cause error) error {
+	lm.logger().Warn("Couldn't confirm the lock for the holder, undoing", "previous_holder", previous, "error", cause)
+	resultErr := multierror.Append(nil, fmt.Errorf("failed to confirm the lock for %s: %w", lockValue, cause))
+	var err error
+	if previous == "" {
+		_, err = lm.uriLocker.Unlock(lockValue)
+	} else {
+		err = lm.returnLock(lockValue, previous, previousRecord)
+	}
+	if err != nil {
+		lm.logger().Error("Couldn't undo obtaining the lock, it's held without being shown on the holder", "error", err)
+		return multierror.Append(resultErr, fmt.Errorf("failed to undo obtaining the lock: %w", err))
+	}
+
+	lm.acquiredAt = time.Time{}
+	lm.stolenFrom = ""
+	lm.stolenBy = ""
+	lm.preemptedFrom = ""
+	if previous == "" {
+		lm.locked = false
+		lm.unlocked = true
+		lm.htmlURL = ""
+	} else {
+		lm.htmlURL = previous
+	}
+	lm.recordHistory(historyRollback, lockValue)
+	return resultErr
+}
+
+// returnLock hands a lock taken from previous back to it
+func (lm *LabelMutex) returnLock(lockValue string, previous string, previousRecord []byte) error {
+	stealer, ok := lm.uriLocker.(StealableLocker)
+	if !ok {
+		return fmt.Errorf("lock '%s' can't be returned to %s", lm.label, previous)
+	}
+	returned, err := stealer.Steal(lockValue, previous)
+	if err != nil {
+		return err
+	}
+	if !returned {
+		return fmt.Errorf("lock changed hands before it could be returned to %s", previous)
+	}
+	records, ok := lm.records()
+	if !ok || len(previousRecord) == 0 {
+		return nil
+	}
+	return records.PutRecord(lm.holderKey(), previousRecord)
+}
+
+// rollbackSharedHold undoes obtaining a shared hold the holder couldn't be labeled with
+func (lm *LabelMutex) rollbackSharedHold(sharedLocker SharedLocker, lockValue string, cause error) error {
+	lm.logger().Warn("Couldn't confirm the shared hold for the holder, undoing", "error", cause)
+	resultErr := multierror.Append(nil, fmt.Errorf("failed to confirm the shared hold for %s: %w", lockValue, cause))
+	err := sharedLocker.RUnlock(lockValue)
+	if err != nil {
+		lm.logger().Error("Couldn't undo obtaining the shared hold, it's held without being shown on the holder", "error", err)
+		return multierror.Append(resultErr, fmt.Errorf("failed to undo obtaining the shared hold: %w", err))
+	}
+	lm.acquiredAt = time.Time{}
+	lm.sharedHold = false
+	lm.htmlURL = ""
+	lm.readers, err = sharedLocker.Readers()
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	lm.locked = len(lm.readers) > 0
+	lm.unlocked = !lm.locked
+	lm.recordHistory(historyRollback, lockValue)
+	return resultErr
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/v55/github"
+	"github.com/hashicorp/go-multierror"
+)
+
+type teamsService interface {
+	GetTeamMembershipBySlug(ctx context.Context, org string, slug string, user string) (*github.Membership, *github.Response, error)
+}
+
+type permissionsService interface {
+	GetPermissionLevel(ctx context.Context, owner string, repo string, user string) (*github.RepositoryPermissionLevel, *github.Response, error)
+}
+
+// permissionRanks orders the repository permission levels accepted by the 'permission' input
+var permissionRanks = map[string]int{
+	"none":     0,
+	"read":     1,
+	"triage":   2,
+	"write":    3,
+	"maintain": 4,
+	"admin":    5,
+}
+
+// permissionKeys maps repository permission levels to the permissions reported for a collaborator
+var permissionKeys = map[string]string{
+	"read":     "pull",
+	"triage":   "triage",
+	"write":    "push",
+	"maintain": "maintain",
+	"admin":    "admin",
+}
+
+// allowed is true when the login is listed in the allowlist, either directly or as an active member of a team listed
+// as 'org/team-slug'. Nobody is allowed by an empty allowlist.
+func (lm *LabelMutex) allowed(allowlist []string, login string) (bool, error) {
+	for _, entry := range allowlist {
+		entry = strings.TrimPrefix(strings.TrimSpace(entry), "@")
+		org, slug, isTeam := strings.Cut(entry, "/")
+		if !isTeam {
+			if strings.EqualFold(entry, login) {
+				return true, nil
+			}
+			continue
+		}
+		membership, resp, err := lm.teamsClient.GetTeamMembershipBySlug(lm.context, org, slug, login)
+		if resp != nil && resp.Response != nil && resp.Response.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if membership.GetState() == "active" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authorized is true when the login may request the lock. Everyone may request the lock unless requesters are limited
+// to an allowlist or a minimum repository permission level, in which case satisfying either is enough.
+func (lm *LabelMutex) authorized(login string) (bool, error) {
+	if len(lm.allowedRequesters) == 0 && lm.permission == "" {
+		return true, nil
+	}
+	allowed, err := lm.allowed(lm.allowedRequesters, login)
+	if err != nil || allowed || lm.permission == "" {
+		return allowed, err
+	}
+	return lm.hasPermission(login)
+}
+
+// hasPermission is true when the login has at least the configured permission level on the repository
+func (lm *LabelMutex) hasPermission(login string) (bool, error) {
+	level, _, err := lm.permissionsClient.GetPermissionLevel(lm.context, lm.holder.Owner(), lm.holder.Repo(), login)
+	if err != nil {
+		return false, err
+	}
+	if user := level.GetUser(); user != nil && user.Permissions != nil {
+		return user.Permissions[permissionKeys[lm.permission]], nil
+	}
+	// only the classic permission levels are reported without the collaborator's permissions
+	return permissionRanks[level.GetPermission()] >= permissionRanks[lm.permission], nil
+}
+
+// refuseRequest removes a label requesting the lock that was added by someone who isn't allowed to request it,
+// explaining why on the PR. Anything the PR already holds is released along with the labels confirming it.
+func (lm *LabelMutex) refuseRequest(login string, label string) error {
+	var resultErr *multierror.Error
+	lm.logger().Info("Requester isn't allowed to request the lock, removing its label", "requester", login, "removed_label", label)
+	lm.unauthorized = login
+	err := lm.removeLabel(label)
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	err = lm.releaseRefused()
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	err = lm.comment(lm.holder.Number(), fmt.Sprintf("@%s isn't allowed to request the `%s` lock, so `%s` was removed. %s", login, lm.label, label, lm.requirements()))
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	err = lm.processOther()
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	return resultErr.ErrorOrNil()
+}
+
+// releaseRefused releases the lock and any shared hold obtained by the holder of a refused request, removing the labels
+// confirming them
+func (lm *LabelMutex) releaseRefused() error {
+	var resultErr *multierror.Error
+	if sharedLocker, ok := lm.uriLocker.(SharedLocker); ok && lm.shared {
+		readers, err := sharedLocker.Readers()
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+		for _, reader := range readers {
+			if reader == lm.holder.URL() {
+				err = sharedLocker.RUnlock(reader)
+				if err != nil {
+					resultErr = multierror.Append(resultErr, err)
+				} else {
+					lm.logger().Info("Released the shared hold of the refused request")
+					lm.recordHistory(historyRelease, reader)
+				}
+			}
+		}
+	}
+
+	value, err := lm.uriLocker.Read()
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	} else if value != "" && value == lm.holder.URL() {
+		_, err = lm.uriLocker.Unlock(value)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		} else {
+			lm.logger().Info("Released the lock obtained by the refused request")
+			lm.released = true
+			lm.recordHistory(historyRelease, value)
+			err = lm.deactivateDeployments()
+			if err != nil {
+				resultErr = multierror.Append(resultErr, err)
+			}
+			err = lm.notifyWaiters(value)
+			if err != nil {
+				resultErr = multierror.Append(resultErr, err)
+			}
+		}
+	}
+
+	for _, label := range []string{fmt.Sprintf("%s:%s", lm.label, lockedSuffix), fmt.Sprintf("%s:%s", lm.sharedLabel(), lockedSuffix)} {
+		if !lm.holder.hasLabel(label) {
+			continue
+		}
+		err = lm.removeLabel(label)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	return resultErr.ErrorOrNil()
+}
+
+// refuseRun leaves the lock alone when a workflow run or dispatch was triggered by someone who isn't allowed to
+// request it, since there's no label to remove
+func (lm *LabelMutex) refuseRun(login string) error {
+	lm.logger().Info("Requester isn't allowed to request the lock, ignoring the run", "requester", login)
+	lm.unauthorized = login
+	return lm.processOther()
+}
+
+// requirements describes who may request the lock
+func (lm *LabelMutex) requirements() string {
+	var requirements []string
+	if len(lm.allowedRequesters) > 0 {
+		requirements = append(requirements, fmt.Sprintf("be one of `%s`", strings.Join(lm.allowedRequesters, "`, `")))
+	}
+	if lm.permission != "" {
+		requirements = append(requirements, fmt.Sprintf("have `%s` permission on the repository", lm.permission))
+	}
+	return fmt.Sprintf("Requesters must %s.", strings.Join(requirements, " or "))
+}
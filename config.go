@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	backendDynamo = "dynamo"
+	backendGCS    = "gcs"
+)
+
+// lockConfig describes a single lock and the label used to control it
+type lockConfig struct {
+	Name           string            `yaml:"name"`
+	Locks          []string          `yaml:"locks"`
+	Label          string            `yaml:"label"`
+	Pattern        bool              `yaml:"pattern"`
+	Backend        string            `yaml:"backend"`
+	Table          string            `yaml:"table"`
+	Partition      string            `yaml:"partition"`
+	Bucket         string            `yaml:"bucket"`
+	TTL            time.Duration     `yaml:"ttl"`
+	Slots          int               `yaml:"slots"`
+	Shared         bool              `yaml:"shared"`
+	Environment    string            `yaml:"environment"`
+	OnConflict     string            `yaml:"on_conflict"`
+	StealAllowed   []string          `yaml:"steal_allowed"`
+	Allowed        []string          `yaml:"allowed"`
+	Permission     string            `yaml:"permission"`
+	Notify         string            `yaml:"notify"`
+	Calendar       string            `yaml:"calendar"`
+	Priority       string            `yaml:"priority"`
+	Priorities     map[string]string `yaml:"priorities"`
+	GracePeriod    time.Duration     `yaml:"grace_period"`
+	MaxHold        time.Duration     `yaml:"max_hold"`
+	MaxHoldWarning time.Duration     `yaml:"max_hold_warning"`
+}
+
+// fileConfig is the format of the file referenced by the 'config_file' input
+type fileConfig struct {
+	Locks []lockConfig `yaml:"locks"`
+}
+
+// loadLockConfigs reads the locks declared in a YAML file, using the provided config for any unset fields
+func loadLockConfigs(path string, defaults lockConfig) ([]lockConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fc fileConfig
+	err = yaml.Unmarshal(data, &fc)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %w", path, err)
+	}
+	if len(fc.Locks) == 0 {
+		return nil, fmt.Errorf("%s doesn't declare any locks", path)
+	}
+
+	var resultErr *multierror.Error
+	names := make(map[string]bool)
+	for i := range fc.Locks {
+		lc := &fc.Locks[i]
+		lc.applyDefaults(defaults)
+		if names[lc.Name] {
+			resultErr = multierror.Append(resultErr, fmt.Errorf("lock '%s' declared more than once", lc.Name))
+		}
+		names[lc.Name] = true
+		if err := lc.Validate(); err != nil {
+			resultErr = multierror.Append(resultErr, fmt.Errorf("lock %d: %w", i, err))
+		}
+	}
+	return fc.Locks, resultErr.ErrorOrNil()
+}
+
+func (lc *lockConfig) applyDefaults(defaults lockConfig) {
+	if lc.Name == "" && len(lc.Locks) > 0 {
+		lc.Name = strings.Join(lc.Locks, "+")
+	}
+	if lc.Backend == "" {
+		switch {
+		case lc.Bucket != "":
+			lc.Backend = backendGCS
+		case lc.Table != "":
+			lc.Backend = backendDynamo
+		case defaults.Bucket != "":
+			lc.Backend = backendGCS
+		default:
+			lc.Backend = backendDynamo
+		}
+	}
+	if lc.Bucket == "" {
+		lc.Bucket = defaults.Bucket
+	}
+	if lc.Table == "" {
+		lc.Table = defaults.Table
+	}
+	if lc.Partition == "" {
+		lc.Partition = defaults.Partition
+	}
+	if lc.Environment == "" {
+		lc.Environment = defaults.Environment
+	}
+	if lc.OnConflict == "" {
+		lc.OnConflict = defaults.OnConflict
+	}
+	if len(lc.StealAllowed) == 0 {
+		lc.StealAllowed = defaults.StealAllowed
+	}
+	if len(lc.Allowed) == 0 {
+		lc.Allowed = defaults.Allowed
+	}
+	if lc.Permission == "" {
+		lc.Permission = defaults.Permission
+	}
+	if lc.Notify == "" {
+		lc.Notify = defaults.Notify
+	}
+	if lc.Calendar == "" {
+		lc.Calendar = defaults.Calendar
+	}
+	if lc.Priority == "" {
+		lc.Priority = defaults.Priority
+	}
+	if len(lc.Priorities) == 0 {
+		lc.Priorities = defaults.Priorities
+	}
+	if lc.GracePeriod == 0 {
+		lc.GracePeriod = defaults.GracePeriod
+	}
+	if lc.MaxHold == 0 {
+		lc.MaxHold = defaults.MaxHold
+	}
+	if lc.MaxHoldWarning == 0 {
+		lc.MaxHoldWarning = defaults.MaxHoldWarning
+	}
+}
+
+func (lc *lockConfig) Validate() error {
+	var resultErr *multierror.Error
+	if lc.Name == "" && !lc.Pattern {
+		resultErr = multierror.Append(resultErr, errors.New("'name' missing"))
+	}
+	if lc.Label == "" {
+		resultErr = multierror.Append(resultErr, errors.New("'label' missing"))
+	}
+	if lc.Pattern {
+		if _, err := newLabelPattern(lc.Label); err != nil {
+			resultErr = multierror.Append(resultErr, fmt.Errorf("invalid label pattern '%s': %w", lc.Label, err))
+		}
+		if len(lc.Locks) > 0 {
+			resultErr = multierror.Append(resultErr, errors.New("'locks' can't be used with a label pattern"))
+		}
+	}
+	for _, name := range lc.Locks {
+		if name == "" {
+			resultErr = multierror.Append(resultErr, errors.New("'locks' can't contain an empty name"))
+		}
+	}
+	switch lc.Backend {
+	case backendDynamo:
+		if lc.Table == "" {
+			resultErr = multierror.Append(resultErr, errors.New("'table' is required for the dynamo backend"))
+		}
+		if lc.Partition == "" {
+			resultErr = multierror.Append(resultErr, errors.New("'partition' is required for the dynamo backend"))
+		}
+	case backendGCS:
+		if lc.Bucket == "" {
+			resultErr = multierror.Append(resultErr, errors.New("'bucket' is required for the gcs backend"))
+		}
+	default:
+		resultErr = multierror.Append(resultErr, fmt.Errorf("'backend' must be one of '%s' or '%s'", backendDynamo, backendGCS))
+	}
+	if lc.TTL < 0 {
+		resultErr = multierror.Append(resultErr, errors.New("'ttl' can't be negative"))
+	}
+	if lc.Slots < 0 {
+		resultErr = multierror.Append(resultErr, errors.New("'slots' can't be negative"))
+	}
+	if lc.Shared && (lc.Slots > 1 || len(lc.Locks) > 0) {
+		resultErr = multierror.Append(resultErr, errors.New("'shared' can't be used with 'slots' or 'locks'"))
+	}
+	// locks made up of several underlying locks can't be taken from their holders
+	if len(lc.StealAllowed) > 0 && (lc.Slots > 1 || len(lc.Locks) > 0) {
+		resultErr = multierror.Append(resultErr, errors.New("'steal_allowed' can't be used with 'slots' or 'locks'"))
+	}
+	if (len(lc.Priorities) > 0 || lc.GracePeriod > 0) && (lc.Slots > 1 || len(lc.Locks) > 0) {
+		resultErr = multierror.Append(resultErr, errors.New("'priorities' and 'grace_period' can't be used with 'slots' or 'locks'"))
+	}
+	if _, ok := permissionKeys[lc.Permission]; lc.Permission != "" && !ok {
+		resultErr = multierror.Append(resultErr, errors.New("'permission' must be one of 'read', 'triage', 'write', 'maintain' or 'admin'"))
+	}
+	if _, ok := priorityRanks[lc.Priority]; lc.Priority != "" && !ok {
+		resultErr = multierror.Append(resultErr, fmt.Errorf("'priority' must be one of '%s', '%s', '%s' or '%s'", priorityLow, priorityNormal, priorityHigh, priorityUrgent))
+	}
+	for entry, level := range lc.Priorities {
+		if _, ok := priorityRanks[level]; !ok {
+			resultErr = multierror.Append(resultErr, fmt.Errorf("priority of '%s' must be one of '%s', '%s', '%s' or '%s'", entry, priorityLow, priorityNormal, priorityHigh, priorityUrgent))
+		}
+	}
+	if lc.GracePeriod < 0 {
+		resultErr = multierror.Append(resultErr, errors.New("'grace_period' can't be negative"))
+	}
+	if lc.MaxHold < 0 {
+		resultErr = multierror.Append(resultErr, errors.New("'max_hold' can't be negative"))
+	}
+	if lc.MaxHoldWarning < 0 || (lc.MaxHold > 0 && lc.MaxHoldWarning >= lc.MaxHold) {
+		resultErr = multierror.Append(resultErr, errors.New("'max_hold_warning' must be shorter than 'max_hold'"))
+	}
+	switch lc.Notify {
+	case "", notifyComment, notifyRelabel, notifyNone:
+	default:
+		resultErr = multierror.Append(resultErr, fmt.Errorf("'notify' must be one of '%s', '%s' or '%s'", notifyComment, notifyRelabel, notifyNone))
+	}
+	switch lc.OnConflict {
+	case onConflictFail, onConflictWarn, onConflictIgnore:
+	default:
+		resultErr = multierror.Append(resultErr, fmt.Errorf("'on_conflict' must be one of '%s', '%s' or '%s'", onConflictFail, onConflictWarn, onConflictIgnore))
+	}
+	return resultErr.ErrorOrNil()
+}
+
+// newLabelMutex initializes a LabelMutex for the lock described by the config. Locks controlled by a label pattern
+// are initialized as their labels are found.
+func (lc *lockConfig) newLabelMutex() (*LabelMutex, error) {
+	config := *lc
+	lm := &LabelMutex{
+		label:             lc.Label,
+		lock:              lc.Name,
+		environment:       lc.Environment,
+		onConflict:        lc.OnConflict,
+		shared:            lc.Shared,
+		stealAllowed:      lc.StealAllowed,
+		allowedRequesters: lc.Allowed,
+		permission:        lc.Permission,
+		notify:            lc.Notify,
+		priority:          lc.Priority,
+		priorities:        lc.Priorities,
+		gracePeriod:       lc.GracePeriod,
+		maxHold:           lc.MaxHold,
+		maxHoldWarning:    lc.MaxHoldWarning,
+		newLocker:         config.newLocker,
+	}
+	if lc.Calendar != "" {
+		calendar, err := loadCalendar(lc.Calendar)
+		if err != nil {
+			return nil, err
+		}
+		lm.calendar = calendar
+	}
+	if lc.Pattern {
+		pattern, err := newLabelPattern(lc.Label)
+		if err != nil {
+			return nil, err
+		}
+		lm.pattern = pattern
+		return lm, nil
+	}
+	if len(lc.Locks) > 0 {
+		var members []namedLocker
+		for _, name := range lc.Locks {
+			uriLocker, err := lc.newLocker(name)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, namedLocker{name: name, locker: uriLocker})
+		}
+		lm.uriLocker = newGroupLocker(lc.Name, members)
+		return lm, nil
+	}
+	uriLocker, err := lc.newLocker(lc.Name)
+	if err != nil {
+		return nil, err
+	}
+	lm.uriLocker = uriLocker
+	return lm, nil
+}
+
+// newLocker initializes the URILocker for the named lock using the backend described by the config
+func (lc *lockConfig) newLocker(name string) (URILocker, error) {
+	if lc.Slots <= 1 {
+		uriLocker, err := lc.newBackendLocker(name)
+		if err != nil {
+			return nil, err
+		}
+		if records, ok := uriLocker.(recordStore); ok && lc.Shared {
+			return newSharedLocker(name, uriLocker, records, lc.TTL), nil
+		}
+		return uriLocker, nil
+	}
+	sl := &slotLocker{name: name}
+	for i := 0; i < lc.Slots; i++ {
+		locker, err := lc.newBackendLocker(slotName(name, i))
+		if err != nil {
+			return nil, err
+		}
+		sl.slots = append(sl.slots, locker)
+	}
+	return sl, nil
+}
+
+func (lc *lockConfig) newBackendLocker(name string) (URILocker, error) {
+	var uriLocker URILocker
+	var err error
+	if lc.Backend == backendGCS {
+		uriLocker, err = NewGCSLocker(lc.Bucket, name, lc.TTL)
+	} else {
+		uriLocker, err = NewDynamoURILocker(lc.Table, lc.Partition, name, lc.TTL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return uriLocker, nil
+}
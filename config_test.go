@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v55/github"
+	"github.com/google/uuid"
+)
+
+func TestLoadLockConfigs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.yml")
+	err := os.WriteFile(path, []byte(`
+locks:
+  - name: staging
+    label: staging
+  - name: qa
+    label: qa
+    backend: gcs
+    bucket: qa-locks
+    ttl: 2h
+  - name: perf
+    label: perf
+    slots: 3
+    on_conflict: fail
+  - label: staging-backends
+    locks:
+      - staging-db
+      - staging-api
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locks, err := loadLockConfigs(path, lockConfig{Table: "label-mutex", Partition: "label", OnConflict: onConflictWarn})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	want := []lockConfig{
+		{Name: "staging", Label: "staging", Backend: backendDynamo, Table: "label-mutex", Partition: "label", OnConflict: onConflictWarn},
+		{Name: "qa", Label: "qa", Backend: backendGCS, Table: "label-mutex", Partition: "label", Bucket: "qa-locks", TTL: 2 * time.Hour, OnConflict: onConflictWarn},
+		{Name: "perf", Label: "perf", Backend: backendDynamo, Table: "label-mutex", Partition: "label", Slots: 3, OnConflict: onConflictFail},
+		{Name: "staging-db+staging-api", Locks: []string{"staging-db", "staging-api"}, Label: "staging-backends", Backend: backendDynamo, Table: "label-mutex", Partition: "label", OnConflict: onConflictWarn},
+	}
+	if len(locks) != len(want) {
+		t.Fatalf("got %d locks, want %d", len(locks), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(locks[i], want[i]) {
+			t.Errorf("lock %d: got %+v, want %+v", i, locks[i], want[i])
+		}
+	}
+}
+
+func TestLoadLockConfigsInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.yml")
+	err := os.WriteFile(path, []byte(`
+locks:
+  - name: staging
+    label: staging
+  - name: staging
+    backend: gcs
+    slots: -1
+  - name: qa
+    label: qa
+    priority: highest
+    priorities:
+      urcomputeringpal/hotfixers: soon
+    grace_period: -1m
+    max_hold: 1h
+    max_hold_warning: 2h
+  - name: perf
+    label: perf
+    slots: 3
+    steal_allowed:
+      - jnewland
+    grace_period: 15m
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadLockConfigs(path, lockConfig{Table: "label-mutex", Partition: "label", OnConflict: onConflictWarn})
+	if err == nil {
+		t.Fatal("expected an error, didn't get one")
+	}
+	for _, msg := range []string{"declared more than once", "'label' missing", "'bucket' is required", "'slots' can't be negative", "'priority' must be one of", "priority of 'urcomputeringpal/hotfixers' must be one of", "'grace_period' can't be negative", "'max_hold_warning' must be shorter than 'max_hold'", "'steal_allowed' can't be used with 'slots' or 'locks'", "'priorities' and 'grace_period' can't be used with 'slots' or 'locks'"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("got %v, want an error containing %q", err, msg)
+		}
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	mutexes := []*LabelMutex{
+		{lock: "staging", locked: true, htmlURL: "https://github.com/urcomputeringpal/label-mutex/pull/1"},
+		{lock: "qa", unlocked: true},
+	}
+	output, err := outputs(mutexes, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"staging_locked":   "true",
+		"staging_html_url": "https://github.com/urcomputeringpal/label-mutex/pull/1",
+		"qa_locked":        "false",
+		"qa_unlocked":      "true",
+		"locks":            `{"qa":{"acquired":"false","locked":"false","unlocked":"true"},"staging":{"acquired":"false","html_url":"https://github.com/urcomputeringpal/label-mutex/pull/1","locked":"true","unlocked":"false"}}`,
+	}
+	for k, v := range expected {
+		if output[k] != v {
+			t.Errorf("outputs.%s: got %v, want %v", k, output[k], v)
+		}
+	}
+}
+
+func TestProcessEventEvaluatesEveryLock(t *testing.T) {
+	c := &config{mode: modeLock}
+	locks := []lockConfig{
+		{Name: "broken", Label: "broken", Backend: backendDynamo, Table: "label-mutex", Partition: "staging", Calendar: filepath.Join(t.TempDir(), "missing.yml")},
+		{Name: fmt.Sprintf("%v", uuid.New()), Label: "staging", Backend: backendDynamo, Table: "label-mutex", Partition: "staging"},
+	}
+	mutexes, err := c.processEvent(context.Background(), github.NewClient(nil), locks, "push", []byte(`{}`))
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("got %v, want an error for the broken lock", err)
+	}
+	if len(mutexes) != 1 || mutexes[0].label != "staging" || !mutexes[0].unlocked {
+		t.Errorf("the remaining lock should still be evaluated: got %+v", mutexes)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/google/go-github/v55/github"
+)
+
+var (
+	deploymentTask = "deploy:label-mutex"
+)
+
+type deploymentsService interface {
+	ListDeployments(ctx context.Context, owner, repo string, opts *github.DeploymentsListOptions) ([]*github.Deployment, *github.Response, error)
+	CreateDeployment(ctx context.Context, owner, repo string, request *github.DeploymentRequest) (*github.Deployment, *github.Response, error)
+	CreateDeploymentStatus(ctx context.Context, owner, repo string, deployment int64, request *github.DeploymentStatusRequest) (*github.DeploymentStatus, *github.Response, error)
+	ListDeploymentStatuses(ctx context.Context, owner, repo string, deployment int64, opts *github.ListOptions) ([]*github.DeploymentStatus, *github.Response, error)
+}
+
+type deploymentPayload struct {
+	HTMLURL string `json:"html_url"`
+}
+
+// ensureDeployment creates a deployment and an in_progress status for the commit of the holder of the lock
+// unless one already exists in the configured environment, marking an existing one in_progress again if it was made
+// inactive when the lock was released. Deployments of the holder's earlier commits are marked inactive.
+func (lm *LabelMutex) ensureDeployment() error {
+	if lm.environment == "" || lm.deploymentsClient == nil {
+		return nil
+	}
+	if lm.fork {
+		// deployment workflows check out the deployed ref with access to secrets, so code from forks is never deployed
+		lm.logger().Info("Not creating a deployment for a fork", "environment", lm.environment)
+		return nil
+	}
+	owner := lm.holder.Owner()
+	repo := lm.holder.Repo()
+	sha := lm.holder.SHA()
+	if sha == "" {
+		lm.logger().Info("Not creating a deployment for a holder without a commit", "environment", lm.environment)
+		return nil
+	}
+
+	deployments, err := lm.ownDeployments(&github.DeploymentsListOptions{SHA: sha})
+	if err != nil {
+		return err
+	}
+	if len(deployments) > 0 {
+		lm.deploymentID = deployments[0].GetID()
+		// statuses are listed newest first
+		statuses, _, err := lm.deploymentsClient.ListDeploymentStatuses(lm.context, owner, repo, lm.deploymentID, &github.ListOptions{PerPage: 1})
+		if err != nil {
+			return err
+		}
+		if len(statuses) > 0 && statuses[0].GetState() != "inactive" {
+			lm.logger().Info("Deployment already exists", "deployment_id", lm.deploymentID, "environment", lm.environment, "sha", sha)
+			return nil
+		}
+		err = lm.deactivateDeploymentsExcept(sha)
+		if err != nil {
+			return err
+		}
+		lm.logger().Info("Reactivating deployment", "deployment_id", lm.deploymentID, "environment", lm.environment, "sha", sha)
+		_, _, err = lm.deploymentsClient.CreateDeploymentStatus(lm.context, owner, repo, lm.deploymentID, deploymentStatus("in_progress", fmt.Sprintf("Lock '%s' obtained", lm.label)))
+		return err
+	}
+
+	err = lm.deactivateDeploymentsExcept(sha)
+	if err != nil {
+		return err
+	}
+	lm.logger().Info("Creating deployment", "environment", lm.environment, "sha", sha)
+	deployment, _, err := lm.deploymentsClient.CreateDeployment(lm.context, owner, repo, &github.DeploymentRequest{
+		Ref:              github.String(sha),
+		Task:             github.String(deploymentTask),
+		AutoMerge:        github.Bool(false),
+		RequiredContexts: &[]string{},
+		Payload:          deploymentPayload{HTMLURL: lm.holder.URL()},
+		Environment:      github.String(lm.environment),
+		Description:      github.String(fmt.Sprintf("Lock '%s' held by %s", lm.label, lm.holder.URL())),
+	})
+	if err != nil {
+		return err
+	}
+	lm.deploymentID = deployment.GetID()
+
+	_, _, err = lm.deploymentsClient.CreateDeploymentStatus(lm.context, owner, repo, lm.deploymentID, deploymentStatus("in_progress", fmt.Sprintf("Lock '%s' obtained", lm.label)))
+	return err
+}
+
+// deactivateDeployments marks every deployment created on behalf of the holder as inactive.
+func (lm *LabelMutex) deactivateDeployments() error {
+	if lm.environment == "" || lm.deploymentsClient == nil {
+		return nil
+	}
+	return lm.deactivateDeploymentsExcept("")
+}
+
+// deactivateDeploymentsExcept marks the deployments created on behalf of the holder for commits other than sha as
+// inactive, skipping those that already are.
+func (lm *LabelMutex) deactivateDeploymentsExcept(sha string) error {
+	owner := lm.holder.Owner()
+	repo := lm.holder.Repo()
+
+	deployments, err := lm.ownDeployments(&github.DeploymentsListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, deployment := range deployments {
+		if sha != "" && deployment.GetSHA() == sha {
+			continue
+		}
+		// statuses are listed newest first
+		statuses, _, err := lm.deploymentsClient.ListDeploymentStatuses(lm.context, owner, repo, deployment.GetID(), &github.ListOptions{PerPage: 1})
+		if err != nil {
+			return err
+		}
+		if len(statuses) > 0 && statuses[0].GetState() == "inactive" {
+			continue
+		}
+		description := fmt.Sprintf("Lock '%s' released", lm.label)
+		if sha != "" {
+			description = fmt.Sprintf("Superseded by a deployment of %s", sha)
+		}
+		lm.logger().Info("Marking deployment inactive", "deployment_id", deployment.GetID(), "environment", lm.environment)
+		_, _, err = lm.deploymentsClient.CreateDeploymentStatus(lm.context, owner, repo, deployment.GetID(), deploymentStatus("inactive", description))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownDeployments lists the deployments to the configured environment that were created on behalf of the PR.
+func (lm *LabelMutex) ownDeployments(opts *github.DeploymentsListOptions) ([]*github.Deployment, error) {
+	opts.Task = deploymentTask
+	opts.Environment = lm.environment
+	opts.PerPage = 100
+	var own []*github.Deployment
+	for {
+		deployments, resp, err := lm.deploymentsClient.ListDeployments(lm.context, lm.holder.Owner(), lm.holder.Repo(), opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, deployment := range deployments {
+			var payload deploymentPayload
+			if err := json.Unmarshal(deployment.Payload, &payload); err != nil {
+				continue
+			}
+			if payload.HTMLURL == lm.holder.URL() {
+				own = append(own, deployment)
+			}
+		}
+		if resp == nil || resp.NextPage == 0 {
+			return own, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func deploymentStatus(state string, description string) *github.DeploymentStatusRequest {
+	request := &github.DeploymentStatusRequest{
+		State:       github.String(state),
+		Description: github.String(description),
+	}
+	if os.Getenv("GITHUB_RUN_ID") != "" {
+		request.LogURL = github.String(fmt.Sprintf("%s/%s/actions/runs/%s", os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID")))
+	}
+	return request
+}
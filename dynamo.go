@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -13,16 +16,25 @@ import (
 )
 
 type dynamoUriLocker struct {
+	lockerTracer
 	dynalock dynalock.Store
 	name     string
+	ttl      time.Duration
+	expired  string
 }
 
-// NewDynamoURILocker initializes a dynamoUriLocker
-func NewDynamoURILocker(table string, partition string, name string) (*dynamoUriLocker, error) {
+// NewDynamoURILocker initializes a dynamoUriLocker. Locks expire after ttl unless it is zero.
+func NewDynamoURILocker(table string, partition string, name string, ttl time.Duration) (*dynamoUriLocker, error) {
 	sess, err := session.NewSession()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create AWS session: %+v", err)
 	}
+	transport := sess.Config.HTTPClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	sess.Config.HTTPClient = &http.Client{Transport: &debugTransport{Transport: transport}}
+	sess.Handlers.Complete.PushBack(observeDynamoRequest)
 
 	var d dynalock.Store
 
@@ -39,45 +51,183 @@ func NewDynamoURILocker(table string, partition string, name string) (*dynamoUri
 	}
 
 	ll := &dynamoUriLocker{
-		dynalock: d,
-		name:     name,
+		lockerTracer: lockerTracer{provider: "dynamo", lock: name},
+		dynalock:     d,
+		name:         name,
+		ttl:          ttl,
 	}
 
 	return ll, nil
 }
 
 func (ll *dynamoUriLocker) Lock(uri string) (bool, string, error) {
-	log.Printf("Attempting to lock %s with value of %s ...\n", ll.name, uri)
+	_, span := ll.startSpan("Lock")
+	defer span.End()
+	ll.logger().Debug("Attempting to lock", "uri", uri)
 	var resultErr *multierror.Error
-	success, value, firstPutErr := ll.dynalock.AtomicPut(ll.name, dynalock.WriteWithNoExpires(), dynalock.WriteWithBytes([]byte(uri)))
+	success, value, firstPutErr := ll.dynalock.AtomicPut(ll.name, ll.expires(), dynalock.WriteWithBytes([]byte(uri)))
 	if firstPutErr != nil {
 		resultErr = multierror.Append(resultErr, firstPutErr)
-		log.Printf("Couldn't obtain lock outright, trying figure out what the current value is. %+v\n", resultErr.ErrorOrNil())
+		ll.logger().Debug("Couldn't obtain lock outright, reading the current value", "error", resultErr.ErrorOrNil())
 		value, getErr := ll.dynalock.Get(ll.name)
 		if getErr != nil {
 			resultErr = multierror.Append(resultErr, getErr)
-			log.Printf("Error reading current lock value too. %+v\n", resultErr.ErrorOrNil())
+			ll.logger().Debug("Couldn't read the current value either", "error", resultErr.ErrorOrNil())
 			return false, "", resultErr.ErrorOrNil()
 		}
 		if string(value.BytesValue()) == uri {
-			success, value, putErr := ll.dynalock.AtomicPut(ll.name, dynalock.WriteWithNoExpires(), dynalock.WriteWithBytes([]byte(uri)), dynalock.WriteWithPreviousKV(value))
+			_, _, putErr := ll.dynalock.AtomicPut(ll.name, ll.expires(), dynalock.WriteWithBytes([]byte(uri)), dynalock.WriteWithPreviousKV(value))
 			if putErr == nil {
-				log.Printf("Lock confirmed: %+v, %+v, %+v", success, value, resultErr.ErrorOrNil())
+				ll.logger().Debug("Lock confirmed", "uri", uri)
 				return false, uri, nil
 			}
 			resultErr = multierror.Append(resultErr, putErr)
-			log.Printf("Error confirming lock: %+v, %+v, %+v", success, value, resultErr.ErrorOrNil())
+			ll.logger().Debug("Couldn't confirm lock", "uri", uri, "error", resultErr.ErrorOrNil())
 			return false, "", resultErr.ErrorOrNil()
 		}
-		log.Printf("Lock value mismatch found. %+v\n", resultErr.ErrorOrNil())
+		ll.logger().Debug("Lock held by another holder", "error", resultErr.ErrorOrNil())
 		return false, string(value.BytesValue()), nil
 	}
-	log.Printf("Lock obtained: %+v, %+v, %+v", success, value, resultErr.ErrorOrNil())
+	ll.logger().Debug("Lock obtained", "uri", uri)
+	token, previous, fenceErr := ll.fence(ll.fenceKey(), uri)
+	if fenceErr != nil {
+		resultErr = multierror.Append(resultErr, fmt.Errorf("couldn't issue a fencing token: %w", fenceErr))
+		_, unlockErr := ll.Unlock(uri)
+		if unlockErr != nil {
+			resultErr = multierror.Append(resultErr, unlockErr)
+		}
+		return false, "", resultErr.ErrorOrNil()
+	}
+	ll.logger().Debug("Issued fencing token", "fencing_token", token)
+	// released locks are deleted, so a lock obtained over an existing item replaced one that expired
+	if value != nil && value.Version > 1 {
+		ll.logger().Info("Lock expired", "previous_holder", previous)
+		ll.expired = previous
+	}
 	return success, uri, resultErr.ErrorOrNil()
 }
 
+func (ll *dynamoUriLocker) Expired() string {
+	expired := ll.expired
+	ll.expired = ""
+	return expired
+}
+
+// Steal replaces the holder of the lock with the URI so long as the lock hasn't changed hands since it was read
+func (ll *dynamoUriLocker) Steal(previous string, uri string) (bool, error) {
+	_, span := ll.startSpan("Steal")
+	defer span.End()
+	ll.logger().Debug("Attempting to steal", "previous_holder", previous, "uri", uri)
+	value, err := ll.dynalock.Get(ll.name)
+	if err == dynalock.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if string(value.BytesValue()) != previous {
+		return false, nil
+	}
+	_, _, err = ll.dynalock.AtomicPut(ll.name, ll.expires(), dynalock.WriteWithBytes([]byte(uri)), dynalock.WriteWithPreviousKV(value))
+	if err == dynalock.ErrKeyModified {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	token, _, err := ll.fence(ll.fenceKey(), uri)
+	if err != nil {
+		return true, fmt.Errorf("couldn't issue a fencing token: %w", err)
+	}
+	ll.logger().Debug("Issued fencing token", "fencing_token", token)
+	return true, nil
+}
+
+// dynamoFence is the value of the counter item issuing fencing tokens for a lock
+type dynamoFence struct {
+	Token  int64  `json:"token"`
+	Holder string `json:"holder"`
+}
+
+func (ll *dynamoUriLocker) fenceKey() string {
+	return fmt.Sprintf("%s.fence", ll.name)
+}
+
+// fence increments the counter item stored under the key on behalf of the URI, returning the new token along with the
+// URI it was previously issued to
+func (ll *dynamoUriLocker) fence(key string, uri string) (int64, string, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		var current dynamoFence
+		options := []dynalock.WriteOption{dynalock.WriteWithNoExpires()}
+		previous, err := ll.dynalock.Get(key)
+		if err == nil {
+			err = json.Unmarshal(previous.BytesValue(), &current)
+			if err != nil {
+				return 0, "", err
+			}
+			options = append(options, dynalock.WriteWithPreviousKV(previous))
+		} else if err != dynalock.ErrKeyNotFound {
+			return 0, "", err
+		}
+		next := dynamoFence{Token: current.Token + 1, Holder: uri}
+		value, err := json.Marshal(next)
+		if err != nil {
+			return 0, "", err
+		}
+		_, _, err = ll.dynalock.AtomicPut(key, append(options, dynalock.WriteWithBytes(value))...)
+		if err == dynalock.ErrKeyExists || err == dynalock.ErrKeyModified {
+			continue
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		return next.Token, current.Holder, nil
+	}
+	return 0, "", errors.New("counter kept changing")
+}
+
+func (ll *dynamoUriLocker) IssueFencingToken(key string, uri string) (int64, error) {
+	_, span := ll.startSpan("IssueFencingToken")
+	defer span.End()
+	token, _, err := ll.fence(key, uri)
+	return token, err
+}
+
+// FencingToken returns the token issued when the URI obtained the lock, or zero if it doesn't hold it
+func (ll *dynamoUriLocker) FencingToken(uri string) (int64, error) {
+	_, span := ll.startSpan("FencingToken")
+	defer span.End()
+	holder, err := ll.Read()
+	if err != nil || holder != uri {
+		return 0, err
+	}
+	value, err := ll.dynalock.Get(ll.fenceKey())
+	if err == dynalock.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var current dynamoFence
+	err = json.Unmarshal(value.BytesValue(), &current)
+	if err != nil || current.Holder != uri {
+		return 0, err
+	}
+	return current.Token, nil
+}
+
+// expires renews the lock's TTL on every write
+func (ll *dynamoUriLocker) expires() dynalock.WriteOption {
+	if ll.ttl > 0 {
+		return dynalock.WriteWithTTL(ll.ttl)
+	}
+	return dynalock.WriteWithNoExpires()
+}
+
 func (ll *dynamoUriLocker) Unlock(uri string) (string, error) {
-	log.Printf("Attempting to unlock %s with value of %s ...\n", ll.name, uri)
+	_, span := ll.startSpan("Unlock")
+	defer span.End()
+	ll.logger().Debug("Attempting to unlock", "uri", uri)
 	value, getErr := ll.dynalock.Get(ll.name)
 	if getErr != nil {
 		return "", getErr
@@ -91,7 +241,12 @@ func (ll *dynamoUriLocker) Unlock(uri string) (string, error) {
 }
 
 func (ll *dynamoUriLocker) Read() (string, error) {
+	_, span := ll.startSpan("Read")
+	defer span.End()
 	value, getErr := ll.dynalock.Get(ll.name)
+	if getErr == dynalock.ErrKeyNotFound {
+		return "", nil
+	}
 	if getErr != nil {
 		return "", getErr
 	}
@@ -101,3 +256,55 @@ func (ll *dynamoUriLocker) Read() (string, error) {
 func (ll *dynamoUriLocker) Provider() string {
 	return "dynamo"
 }
+
+func (ll *dynamoUriLocker) CreateRecord(key string, value []byte) (bool, error) {
+	_, span := ll.startSpan("CreateRecord")
+	defer span.End()
+	_, _, err := ll.dynalock.AtomicPut(key, dynalock.WriteWithNoExpires(), dynalock.WriteWithBytes(value))
+	if err == dynalock.ErrKeyExists {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (ll *dynamoUriLocker) PutRecord(key string, value []byte) error {
+	_, span := ll.startSpan("PutRecord")
+	defer span.End()
+	return ll.dynalock.Put(key, dynalock.WriteWithNoExpires(), dynalock.WriteWithBytes(value))
+}
+
+func (ll *dynamoUriLocker) GetRecord(key string) ([]byte, error) {
+	_, span := ll.startSpan("GetRecord")
+	defer span.End()
+	value, err := ll.dynalock.Get(key)
+	if err == dynalock.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value.BytesValue(), nil
+}
+
+func (ll *dynamoUriLocker) DeleteRecord(key string) error {
+	_, span := ll.startSpan("DeleteRecord")
+	defer span.End()
+	return ll.dynalock.Delete(key)
+}
+
+func (ll *dynamoUriLocker) ListRecords(prefix string) (map[string][]byte, error) {
+	_, span := ll.startSpan("ListRecords")
+	defer span.End()
+	records := make(map[string][]byte)
+	values, err := ll.dynalock.List(prefix)
+	if err == dynalock.ErrKeyNotFound {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		records[value.Key] = value.BytesValue()
+	}
+	return records, nil
+}
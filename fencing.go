@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// issuedToken records the fencing token issued to the holder of a lock made up of several underlying locks
+type issuedToken struct {
+	Token  int64  `json:"token"`
+	Holder string `json:"holder"`
+}
+
+// fenceKey is the key of the counter issuing fencing tokens for the named lock
+func fenceKey(name string) string {
+	return fmt.Sprintf("%s.fence", name)
+}
+
+// issueToken issues the next token from the named lock's counter to the URI and records it under the key, using the
+// backend of the provided locker. Backends that can't issue tokens are skipped.
+func issueToken(locker URILocker, name string, key string, uri string) error {
+	counter, ok := locker.(fenceCounter)
+	if !ok {
+		return nil
+	}
+	records, ok := locker.(recordStore)
+	if !ok {
+		return nil
+	}
+	token, err := counter.IssueFencingToken(fenceKey(name), uri)
+	if err != nil {
+		return fmt.Errorf("couldn't issue a fencing token: %w", err)
+	}
+	value, err := json.Marshal(issuedToken{Token: token, Holder: uri})
+	if err != nil {
+		return err
+	}
+	return records.PutRecord(key, value)
+}
+
+// issuedTokenOf returns the token recorded under the key if it was issued to the URI, or zero
+func issuedTokenOf(locker URILocker, key string, uri string) (int64, error) {
+	records, ok := locker.(recordStore)
+	if !ok {
+		return 0, nil
+	}
+	value, err := records.GetRecord(key)
+	if err != nil || len(value) == 0 {
+		return 0, err
+	}
+	var issued issuedToken
+	err = json.Unmarshal(value, &issued)
+	if err != nil || issued.Holder != uri {
+		return 0, err
+	}
+	return issued.Token, nil
+}
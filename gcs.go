@@ -3,25 +3,32 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
-	"github.com/motemen/go-loghttp"
 	"github.com/urcomputeringpal/label-mutex/gcslock"
 	"golang.org/x/oauth2/google"
 )
 
 type gcsLocker struct {
-	lock   gcslock.ContextLocker
-	name   string
-	bucket string
+	lockerTracer
+	lock    gcslock.ContextLocker
+	client  *http.Client
+	name    string
+	bucket  string
+	ttl     time.Duration
+	expired string
 }
 
+// expiresMetadataKey is the custom metadata key holding the unix time at which a lock expires
+const expiresMetadataKey = "expires"
+
 type customTransport struct {
 	Transport http.RoundTripper
 	Endpoint  string
@@ -36,7 +43,8 @@ func (c *customTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return c.Transport.RoundTrip(req)
 }
 
-func NewGCSLocker(bucket string, name string) (ll *gcsLocker, err error) {
+// NewGCSLocker initializes a gcsLocker. Locks expire after ttl unless it is zero.
+func NewGCSLocker(bucket string, name string, ttl time.Duration) (ll *gcsLocker, err error) {
 	var locker gcslock.ContextLocker
 	var client *http.Client
 
@@ -47,77 +55,104 @@ func NewGCSLocker(bucket string, name string) (ll *gcsLocker, err error) {
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: os.Getenv("GCS_INSECURE_SKIP_VERIFY") == "true"},
 		}
 		client = &http.Client{
-			Transport: &customTransport{
-				Endpoint: customEndpoint,
-				Transport: &loghttp.Transport{
-					Transport: insecure,
+			Transport: tracedTransport("gcs", &metricsTransport{
+				Transport: &customTransport{
+					Endpoint: customEndpoint,
+					Transport: &debugTransport{
+						Transport: insecure,
+					},
 				},
-			},
+			}),
 		}
 		locker = gcslock.NewWithClient(client, bucket, name)
 	} else {
 		const scope = "https://www.googleapis.com/auth/devstorage.full_control"
-		client, err := google.DefaultClient(context.TODO(), scope)
+		client, err = google.DefaultClient(context.TODO(), scope)
 		if err != nil {
 			return nil, err
 		}
+		client.Transport = tracedTransport("gcs", &metricsTransport{Transport: &debugTransport{Transport: client.Transport}})
 		locker = gcslock.NewWithClient(client, bucket, name)
 	}
 	ll = &gcsLocker{
-		lock:   locker,
-		name:   name,
-		bucket: bucket,
+		lockerTracer: lockerTracer{provider: "gcs", lock: name},
+		lock:         locker,
+		client:       client,
+		name:         name,
+		bucket:       bucket,
+		ttl:          ttl,
 	}
 	return ll, nil
 }
 
 func (ll *gcsLocker) Lock(uri string) (bool, string, error) {
-	contextWithTimeout, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, span := ll.startSpan("Lock")
+	defer span.End()
+	contextWithTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
-	log.Printf("Reading current lock value for %s ...\n", ll.name)
-	value, _ := ll.lock.ReadValue(contextWithTimeout, ll.bucket, ll.name)
-	if value == uri {
-		log.Printf("Lock already held by %s, returning true\n", uri)
+	ll.logger().Debug("Reading current lock value")
+	object, err := ll.readObject(contextWithTimeout)
+	if err != nil {
+		return false, "", err
+	}
+	if object != nil && object.Value == uri {
+		ll.logger().Debug("Lock already held by the URI", "uri", uri)
+		if ll.ttl > 0 {
+			err := ll.lock.ContextPatchMetadata(contextWithTimeout, object.Generation, ll.metadata())
+			if err != nil {
+				return false, "", fmt.Errorf("couldn't renew lock: %w", err)
+			}
+		}
 		return true, uri, nil
-	} else if value != "" {
-		log.Printf("Lock already held by %s, returning false\n", value)
-		return false, value, nil
+	} else if object != nil {
+		ll.logger().Debug("Lock held by another holder", "current_holder", object.Value)
+		return false, object.Value, nil
 	}
-	log.Printf("Attempting to lock %s with value of %s ...\n", ll.name, uri)
+	ll.logger().Debug("Attempting to lock", "uri", uri)
 	var resultErr *multierror.Error
-	fistWriteErr := ll.lock.ContextLockWithValue(contextWithTimeout, uri)
+	var fistWriteErr error
+	if ll.ttl > 0 {
+		fistWriteErr = ll.lock.ContextLockWithMetadata(contextWithTimeout, uri, ll.metadata())
+	} else {
+		fistWriteErr = ll.lock.ContextLockWithValue(contextWithTimeout, uri)
+	}
 	if fistWriteErr != nil {
-		log.Printf("couldn't obtain lock outright, trying figure out what the current value is. %+v\n", resultErr.ErrorOrNil())
+		ll.logger().Debug("Couldn't obtain lock outright, reading the current value", "error", fistWriteErr)
 		value, getErr := ll.Read()
 		if getErr != nil {
 			resultErr = multierror.Append(resultErr, fistWriteErr)
 			resultErr = multierror.Append(resultErr, getErr)
-			log.Printf("Error reading current lock value too. %+v\n", resultErr.ErrorOrNil())
+			ll.logger().Debug("Couldn't read the current value either", "error", resultErr.ErrorOrNil())
 			return false, "", resultErr.ErrorOrNil()
 		}
 		if value != uri {
 			resultErr = multierror.Append(resultErr, fistWriteErr)
-			log.Printf("Lock value mismatch found. %+v\n", resultErr.ErrorOrNil())
+			ll.logger().Debug("Lock held by another holder", "current_holder", value, "error", resultErr.ErrorOrNil())
 			return false, value, nil
 		}
 	}
-	log.Printf("Lock obtained: %+v, %+v", uri, resultErr.ErrorOrNil())
+	ll.logger().Debug("Lock obtained", "uri", uri, "error", resultErr.ErrorOrNil())
 	return true, uri, resultErr.ErrorOrNil()
 }
 
 func (ll *gcsLocker) Unlock(uri string) (string, error) {
-	log.Printf("Attempting to unlock %s with value of %s ...\n", ll.name, uri)
-	value, getErr := ll.Read()
+	ll.logger().Debug("Attempting to unlock", "uri", uri)
+	ctx, span := ll.startSpan("Unlock")
+	defer span.End()
+	contextWithTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	object, getErr := ll.readObject(contextWithTimeout)
 	if getErr != nil {
 		return "", getErr
 	}
-	if value != uri {
-		return value, fmt.Errorf("couldn't unlock with provided value of %s, lock currently held by %s", uri, value)
+	if object == nil {
+		return "", fmt.Errorf("couldn't unlock with provided value of %s, lock not found", uri)
 	}
-	log.Printf("Lock confirmed, unlocking...")
-	contextWithTimeout, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	err := ll.lock.ContextUnlock(contextWithTimeout)
+	if object.Value != uri {
+		return object.Value, fmt.Errorf("couldn't unlock with provided value of %s, lock currently held by %s", uri, object.Value)
+	}
+	ll.logger().Debug("Lock confirmed, unlocking")
+	err := ll.lock.ContextUnlockGeneration(contextWithTimeout, object.Generation)
 	if err != nil {
 		return "", err
 	} else {
@@ -125,12 +160,190 @@ func (ll *gcsLocker) Unlock(uri string) (string, error) {
 	}
 }
 
+// Steal replaces the holder of the lock with the URI so long as the lock object hasn't been replaced since it was read
+func (ll *gcsLocker) Steal(previous string, uri string) (bool, error) {
+	ll.logger().Debug("Attempting to steal", "previous_holder", previous, "uri", uri)
+	ctx, span := ll.startSpan("Steal")
+	defer span.End()
+	contextWithTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	object, err := ll.readObject(contextWithTimeout)
+	if err != nil || object == nil || object.Value != previous {
+		return false, err
+	}
+	var metadata map[string]string
+	if ll.ttl > 0 {
+		metadata = ll.metadata()
+	}
+	err = ll.lock.ContextReplace(contextWithTimeout, object.Generation, uri, metadata)
+	if err == gcslock.ErrGenerationMismatch || err == gcslock.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 func (ll *gcsLocker) Read() (string, error) {
-	contextWithTimeout, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, span := ll.startSpan("Read")
+	defer span.End()
+	contextWithTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	object, err := ll.readObject(contextWithTimeout)
+	if err != nil || object == nil {
+		return "", err
+	}
+	return object.Value, nil
+}
+
+// readObject returns the current lock object, clearing it first if it has expired
+func (ll *gcsLocker) readObject(ctx context.Context) (*gcslock.Object, error) {
+	object, err := ll.lock.ReadObject(ctx)
+	if err != nil || object == nil {
+		return nil, err
+	}
+	expires, err := strconv.ParseInt(object.Metadata[expiresMetadataKey], 10, 64)
+	if err != nil || time.Now().Unix() < expires {
+		return object, nil
+	}
+	ll.logger().Info("Lock expired, clearing", "previous_holder", object.Value)
+	err = ll.lock.ContextUnlockGeneration(ctx, object.Generation)
+	if err != nil && err != gcslock.ErrNotFound && err != gcslock.ErrGenerationMismatch {
+		return nil, err
+	}
+	if err == nil {
+		ll.expired = object.Value
+	}
+	return ll.lock.ReadObject(ctx)
+}
+
+func (ll *gcsLocker) Expired() string {
+	expired := ll.expired
+	ll.expired = ""
+	return expired
+}
+
+// FencingToken returns the generation of the lock object if it's held by the URI. A new object is written every time
+// the lock is obtained and renewals only change its metadata, so generations increase with every new holder.
+func (ll *gcsLocker) FencingToken(uri string) (int64, error) {
+	ctx, span := ll.startSpan("FencingToken")
+	defer span.End()
+	contextWithTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
-	return ll.lock.ReadValue(contextWithTimeout, ll.bucket, ll.name)
+	object, err := ll.readObject(contextWithTimeout)
+	if err != nil || object == nil || object.Value != uri {
+		return 0, err
+	}
+	return object.Generation, nil
+}
+
+// IssueFencingToken writes the URI to the counter object stored under the key, returning the generation of the object
+// it wrote. Every write creates a new generation, so tokens increase like those of the lock object.
+func (ll *gcsLocker) IssueFencingToken(key string, uri string) (int64, error) {
+	ctx, span := ll.startSpan("IssueFencingToken")
+	defer span.End()
+	contextWithTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	counter := ll.record(key)
+	for attempt := 0; attempt < 5; attempt++ {
+		err := counter.ContextWriteValue(contextWithTimeout, uri)
+		if err != nil {
+			return 0, err
+		}
+		object, err := counter.ReadObject(contextWithTimeout)
+		if err == gcslock.ErrGenerationMismatch {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		// another URI wrote to the counter before its generation could be read
+		if object != nil && object.Value == uri {
+			return object.Generation, nil
+		}
+	}
+	return 0, errors.New("counter kept changing")
+}
+
+func (ll *gcsLocker) metadata() map[string]string {
+	return map[string]string{
+		expiresMetadataKey: strconv.FormatInt(time.Now().Add(ll.ttl).Unix(), 10),
+	}
 }
 
 func (ll *gcsLocker) Provider() string {
 	return "gcs"
 }
+
+func (ll *gcsLocker) record(key string) gcslock.ContextLocker {
+	return gcslock.NewWithClient(ll.client, ll.bucket, key)
+}
+
+func (ll *gcsLocker) CreateRecord(key string, value []byte) (bool, error) {
+	ctx, span := ll.startSpan("CreateRecord")
+	defer span.End()
+	contextWithTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	return ll.record(key).ContextTryLockWithValue(contextWithTimeout, string(value))
+}
+
+func (ll *gcsLocker) PutRecord(key string, value []byte) error {
+	ctx, span := ll.startSpan("PutRecord")
+	defer span.End()
+	contextWithTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	return ll.record(key).ContextWriteValue(contextWithTimeout, string(value))
+}
+
+func (ll *gcsLocker) GetRecord(key string) ([]byte, error) {
+	ctx, span := ll.startSpan("GetRecord")
+	defer span.End()
+	contextWithTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	value, err := ll.record(key).ReadValue(contextWithTimeout, ll.bucket, key)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+func (ll *gcsLocker) DeleteRecord(key string) error {
+	ctx, span := ll.startSpan("DeleteRecord")
+	defer span.End()
+	contextWithTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	err := ll.record(key).ContextDelete(contextWithTimeout)
+	if err == gcslock.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (ll *gcsLocker) ListRecords(prefix string) (map[string][]byte, error) {
+	ctx, span := ll.startSpan("ListRecords")
+	defer span.End()
+	contextWithTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	keys, err := gcslock.List(contextWithTimeout, ll.client, ll.bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string][]byte)
+	for _, key := range keys {
+		// each record is read with a timeout of its own
+		value, err := ll.GetRecord(key)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			records[key] = value
+		}
+	}
+	return records, nil
+}
+
+func (ll *gcsLocker) ListRecordKeys(prefix string) ([]string, error) {
+	ctx, span := ll.startSpan("ListRecordKeys")
+	defer span.End()
+	contextWithTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	return gcslock.List(contextWithTimeout, ll.client, ll.bucket, prefix)
+}
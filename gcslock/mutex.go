@@ -19,14 +19,19 @@ package gcslock
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
-	"log"
+	"log/slog"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
@@ -37,6 +42,14 @@ const (
 	defaultStorageUnlockURL = "https://storage.googleapis.com/storage/v1"
 )
 
+var (
+	// ErrNotFound is returned when a mutex object doesn't exist.
+	ErrNotFound = errors.New("object not found")
+	// ErrGenerationMismatch is returned when a mutex object has been replaced
+	// since it was last read.
+	ErrGenerationMismatch = errors.New("object generation mismatch")
+)
+
 var (
 	// These vars are used in the requests below. Having separate default
 	// values makes it easy to reset the standard config during testing.
@@ -52,6 +65,28 @@ type ContextLocker interface {
 	ContextLockWithValue(context.Context, string) error
 	ContextUnlock(context.Context) error
 	ReadValue(context.Context, string, string) (string, error)
+	ContextLockWithMetadata(context.Context, string, map[string]string) error
+	ContextUnlockGeneration(context.Context, int64) error
+	ContextPatchMetadata(context.Context, int64, map[string]string) error
+	ReadObject(context.Context) (*Object, error)
+	ContextTryLockWithValue(context.Context, string) (bool, error)
+	ContextWriteValue(context.Context, string) error
+	ContextDelete(context.Context) error
+	ContextReplace(context.Context, int64, string, map[string]string) error
+}
+
+// Object describes the current contents of a mutex object.
+type Object struct {
+	Value      string
+	Generation int64
+	Metadata   map[string]string
+}
+
+// objectResource is the subset of the GCS object resource used by this package.
+type objectResource struct {
+	Name       string            `json:"name,omitempty"`
+	Generation string            `json:"generation,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
 }
 
 type mutex struct {
@@ -85,16 +120,127 @@ func (m *mutex) ContextLockWithValue(ctx context.Context, value string) error {
 		"ifGenerationMatch": {"0"},
 	}
 	url := fmt.Sprintf("%s/b/%s/o?%s", storageLockURL, m.bucket, q.Encode())
+	return m.create(ctx, url, "text/plain", []byte(value))
+}
+
+// ContextLockWithMetadata waits indefinitely to acquire a mutex whose
+// object carries the provided custom metadata, with timeout governed by
+// passed context.
+func (m *mutex) ContextLockWithMetadata(ctx context.Context, value string, metadata map[string]string) error {
+	q := url.Values{
+		"uploadType":        {"multipart"},
+		"ifGenerationMatch": {"0"},
+	}
+	url := fmt.Sprintf("%s/b/%s/o?%s", storageLockURL, m.bucket, q.Encode())
+	contentType, body, err := m.multipart(value, metadata)
+	if err != nil {
+		return err
+	}
+	return m.create(ctx, url, contentType, body)
+}
+
+// ContextReplace makes a single attempt to replace the value and custom
+// metadata of a mutex object that is still at the provided generation. It
+// returns ErrGenerationMismatch if the object has been replaced or removed
+// in the meantime.
+func (m *mutex) ContextReplace(ctx context.Context, generation int64, value string, metadata map[string]string) error {
+	q := url.Values{
+		"uploadType":        {"multipart"},
+		"ifGenerationMatch": {strconv.FormatInt(generation, 10)},
+	}
+	contentType, body, err := m.multipart(value, metadata)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/b/%s/o?%s", storageLockURL, m.bucket, q.Encode()), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", contentType)
+	return m.do(ctx, req, nil)
+}
+
+// multipart encodes the body of an upload carrying both the value of the
+// mutex object and its custom metadata.
+func (m *mutex) multipart(value string, metadata map[string]string) (string, []byte, error) {
+	resource, err := json.Marshal(objectResource{Name: m.object, Metadata: metadata})
+	if err != nil {
+		return "", nil, err
+	}
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+	if err != nil {
+		return "", nil, err
+	}
+	part.Write(resource)
+	part, err = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain"}})
+	if err != nil {
+		return "", nil, err
+	}
+	part.Write([]byte(value))
+	if err := w.Close(); err != nil {
+		return "", nil, err
+	}
+	return "multipart/related; boundary=" + w.Boundary(), body.Bytes(), nil
+}
+
+// ContextTryLockWithValue makes a single attempt to acquire a mutex,
+// returning false if it is already held.
+func (m *mutex) ContextTryLockWithValue(ctx context.Context, value string) (bool, error) {
+	q := url.Values{
+		"name":              {m.object},
+		"uploadType":        {"media"},
+		"ifGenerationMatch": {"0"},
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/b/%s/o?%s", storageLockURL, m.bucket, q.Encode()), bytes.NewReader([]byte(value)))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("content-type", "text/plain")
+	err = m.do(ctx, req, nil)
+	if err == ErrGenerationMismatch {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ContextWriteValue replaces the value of a mutex object whether or not
+// the mutex is held.
+func (m *mutex) ContextWriteValue(ctx context.Context, value string) error {
+	q := url.Values{
+		"name":       {m.object},
+		"uploadType": {"media"},
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/b/%s/o?%s", storageLockURL, m.bucket, q.Encode()), bytes.NewReader([]byte(value)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "text/plain")
+	return m.do(ctx, req, nil)
+}
+
+// ContextDelete makes a single attempt to remove a mutex object. It
+// returns ErrNotFound if the object doesn't exist.
+func (m *mutex) ContextDelete(ctx context.Context) error {
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/b/%s/o/%s", storageUnlockURL, m.bucket, m.object), nil)
+	if err != nil {
+		return err
+	}
+	return m.do(ctx, req, nil)
+}
+
+func (m *mutex) create(ctx context.Context, url string, contentType string, body []byte) error {
 	// NOTE: ctx deadline/timeout and backoff are independent. The former is
 	// an aggregate timeout and the latter is a per loop iteration delay.
 	backoff := 10 * time.Millisecond
 	for {
-		req, err := http.NewRequest("POST", url, bytes.NewReader([]byte(value)))
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
 		if err != nil {
 			// Likely malformed URL - retry won't fix so return.
 			return err
 		}
-		req.Header.Set("content-type", "text/plain")
+		req.Header.Set("content-type", contentType)
 		req = req.WithContext(ctx)
 		res, err := m.client.Do(req)
 		if err == nil {
@@ -106,7 +252,7 @@ func (m *mutex) ContextLockWithValue(ctx context.Context, value string) error {
 				return fmt.Errorf("unauthorized")
 			}
 		} else {
-			log.Printf("unexpected error: %+v", err)
+			slog.Warn("Unexpected error, retrying", "error", err)
 		}
 		select {
 		case <-time.After(backoff):
@@ -154,6 +300,110 @@ func (m *mutex) ContextUnlock(ctx context.Context) error {
 	}
 }
 
+// ContextUnlockGeneration releases a mutex only if its object is still at
+// the provided generation. It returns ErrGenerationMismatch if the object
+// has been replaced or removed in the meantime.
+func (m *mutex) ContextUnlockGeneration(ctx context.Context, generation int64) error {
+	q := url.Values{"ifGenerationMatch": {strconv.FormatInt(generation, 10)}}
+	url := fmt.Sprintf("%s/b/%s/o/%s?%s", storageUnlockURL, m.bucket, m.object, q.Encode())
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	return m.do(ctx, req, nil)
+}
+
+// ContextPatchMetadata replaces the custom metadata of a mutex object only
+// if it is still at the provided generation.
+func (m *mutex) ContextPatchMetadata(ctx context.Context, generation int64, metadata map[string]string) error {
+	q := url.Values{"ifGenerationMatch": {strconv.FormatInt(generation, 10)}}
+	url := fmt.Sprintf("%s/b/%s/o/%s?%s", storageUnlockURL, m.bucket, m.object, q.Encode())
+	resource, err := json.Marshal(objectResource{Metadata: metadata})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PATCH", url, bytes.NewReader(resource))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	return m.do(ctx, req, nil)
+}
+
+// ReadObject returns the value, generation and metadata of a mutex object,
+// or nil if the mutex isn't held.
+func (m *mutex) ReadObject(ctx context.Context) (*Object, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/b/%s/o/%s", storageUnlockURL, m.bucket, m.object), nil)
+	if err != nil {
+		return nil, err
+	}
+	var resource objectResource
+	err = m.do(ctx, req, &resource)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	generation, err := strconv.ParseInt(resource.Generation, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generation %q: %w", resource.Generation, err)
+	}
+
+	q := url.Values{
+		"alt":        {"media"},
+		"generation": {resource.Generation},
+	}
+	req, err = http.NewRequest("GET", fmt.Sprintf("%s/b/%s/o/%s?%s", storageUnlockURL, m.bucket, m.object, q.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	res, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		// replaced or removed since the metadata was read
+		return nil, ErrGenerationMismatch
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	bodyBytes, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{
+		Value:      string(bodyBytes),
+		Generation: generation,
+		Metadata:   resource.Metadata,
+	}, nil
+}
+
+// do sends a single request, decoding a JSON response into v if provided.
+func (m *mutex) do(ctx context.Context, req *http.Request, v interface{}) error {
+	req = req.WithContext(ctx)
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == 404:
+		return ErrNotFound
+	case res.StatusCode == 412:
+		return ErrGenerationMismatch
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
 // TODO test
 func (m *mutex) ReadValue(ctx context.Context, bucket, object string) (string, error) {
 	url := fmt.Sprintf("%s/b/%s/o/%s?alt=media", storageUnlockURL, bucket, object)
@@ -181,6 +431,37 @@ func (m *mutex) ReadValue(ctx context.Context, bucket, object string) (string, e
 	return string(bodyBytes), nil
 }
 
+// List returns the names of the objects in a bucket that start with prefix.
+func List(ctx context.Context, client *http.Client, bucket, prefix string) ([]string, error) {
+	m := &mutex{bucket: bucket, client: client}
+	var names []string
+	var pageToken string
+	for {
+		q := url.Values{"prefix": {prefix}}
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/b/%s/o?%s", storageUnlockURL, bucket, q.Encode()), nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items         []objectResource `json:"items"`
+			NextPageToken string           `json:"nextPageToken"`
+		}
+		if err := m.do(ctx, req, &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			names = append(names, item.Name)
+		}
+		if page.NextPageToken == "" {
+			return names, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
 // httpClient is overwritten in tests
 var httpClient = func(ctx context.Context) (*http.Client, error) {
 	const scope = "https://www.googleapis.com/auth/devstorage.full_control"
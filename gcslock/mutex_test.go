@@ -16,20 +16,24 @@
 package gcslock
 
 import (
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/motemen/go-loghttp"
 	"golang.org/x/net/context"
 )
 
 func init() {
 	httpClient = func(context.Context) (*http.Client, error) {
-		return &http.Client{Transport: &loghttp.Transport{}}, nil
+		return &http.Client{Transport: http.DefaultTransport}, nil
 	}
 }
 
@@ -250,3 +254,164 @@ func TestUnlockShouldNotTimeout(t *testing.T) {
 	}
 	m.Unlock()
 }
+
+func TestLockWithMetadata(t *testing.T) {
+	// google cloud storage stub
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("r.Method = %q; want POST", r.Method)
+		}
+		vals := url.Values{
+			"ifGenerationMatch": []string{"0"},
+			"uploadType":        []string{"multipart"},
+		}
+		if !reflect.DeepEqual(r.URL.Query(), vals) {
+			t.Errorf("query params = %q; want %q", r.URL.Query(), vals)
+		}
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("content-type"))
+		if err != nil || mediaType != "multipart/related" {
+			t.Fatalf("content-type = %q; want multipart/related", r.Header.Get("content-type"))
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resource objectResource
+		if err := json.NewDecoder(part).Decode(&resource); err != nil {
+			t.Fatal(err)
+		}
+		want := objectResource{Name: "lock", Metadata: map[string]string{"expires": "42"}}
+		if !reflect.DeepEqual(resource, want) {
+			t.Errorf("resource = %+v; want %+v", resource, want)
+		}
+		part, err = mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := io.ReadAll(part)
+		if string(value) != "value" {
+			t.Errorf("value = %q; want %q", value, "value")
+		}
+	}))
+	defer storage.Close()
+	storageLockURL = storage.URL
+
+	m, err := New(nil, "gcslock", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := m.ContextLockWithMetadata(ctx, "value", map[string]string{"expires": "42"}); err != nil {
+		t.Errorf("ContextLockWithMetadata: %v", err)
+	}
+}
+
+func TestReadObject(t *testing.T) {
+	// google cloud storage stub
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/b/gcslock/o/lock" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("alt") == "media" {
+			if r.URL.Query().Get("generation") != "7" {
+				t.Errorf("generation = %q; want 7", r.URL.Query().Get("generation"))
+			}
+			w.Write([]byte("value"))
+			return
+		}
+		w.Write([]byte(`{"name":"lock","generation":"7","metadata":{"expires":"42"}}`))
+	}))
+	defer storage.Close()
+	storageUnlockURL = storage.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	m, err := New(nil, "gcslock", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, err := m.ReadObject(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Object{Value: "value", Generation: 7, Metadata: map[string]string{"expires": "42"}}
+	if !reflect.DeepEqual(object, want) {
+		t.Errorf("object = %+v; want %+v", object, want)
+	}
+
+	m, err = New(nil, "gcslock", "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, err = m.ReadObject(ctx)
+	if object != nil || err != nil {
+		t.Errorf("ReadObject of a missing object = %+v, %v; want nil, nil", object, err)
+	}
+}
+
+func TestUnlockGeneration(t *testing.T) {
+	// google cloud storage stub
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			t.Errorf("r.Method = %q; want DELETE", r.Method)
+		}
+		if r.URL.Query().Get("ifGenerationMatch") != "7" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer storage.Close()
+	storageUnlockURL = storage.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	m, err := New(nil, "gcslock", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ContextUnlockGeneration(ctx, 7); err != nil {
+		t.Errorf("ContextUnlockGeneration(7): %v", err)
+	}
+	if err := m.ContextUnlockGeneration(ctx, 6); err != ErrGenerationMismatch {
+		t.Errorf("ContextUnlockGeneration(6) = %v; want %v", err, ErrGenerationMismatch)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	// google cloud storage stub
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("r.Method = %q; want POST", r.Method)
+		}
+		if r.URL.Query().Get("uploadType") != "multipart" {
+			t.Errorf("uploadType = %q; want multipart", r.URL.Query().Get("uploadType"))
+		}
+		if r.URL.Query().Get("ifGenerationMatch") != "7" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), "https://github.com/urcomputeringpal/label-mutex/pull/2") {
+			t.Errorf("body = %q; want the new value", body)
+		}
+	}))
+	defer storage.Close()
+	storageLockURL = storage.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	m, err := New(nil, "gcslock", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ContextReplace(ctx, 7, "https://github.com/urcomputeringpal/label-mutex/pull/2", nil); err != nil {
+		t.Errorf("ContextReplace(7): %v", err)
+	}
+	if err := m.ContextReplace(ctx, 6, "https://github.com/urcomputeringpal/label-mutex/pull/2", nil); err != ErrGenerationMismatch {
+		t.Errorf("ContextReplace(6) = %v; want %v", err, ErrGenerationMismatch)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// namedLocker is a URILocker along with the name of the lock it manages
+type namedLocker struct {
+	name   string
+	locker URILocker
+}
+
+// groupLocker obtains several locks on behalf of a single URI, either obtaining all of them or none of them. Locks are
+// always obtained in the same order so that two URIs requesting overlapping groups contend on the same lock first
+// rather than each holding part of what the other needs. Fencing tokens are issued from a counter for the group as a
+// whole, stored alongside its first lock.
+type groupLocker struct {
+	name    string
+	members []namedLocker
+}
+
+func newGroupLocker(name string, members []namedLocker) *groupLocker {
+	sorted := make([]namedLocker, len(members))
+	copy(sorted, members)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].name < sorted[j].name
+	})
+	return &groupLocker{name: name, members: sorted}
+}
+
+func (gl *groupLocker) traceWith(ctx context.Context) {
+	for _, member := range gl.members {
+		traceLocker(member.locker, ctx)
+	}
+}
+
+// Lock obtains every lock in the group, releasing any it obtained if another URI holds one of them
+func (gl *groupLocker) Lock(uri string) (bool, string, error) {
+	var obtained []namedLocker
+	var success bool
+	for _, member := range gl.members {
+		previous, err := member.locker.Read()
+		if err != nil {
+			return false, "", gl.rollback(uri, obtained, err)
+		}
+		memberSuccess, existing, err := member.locker.Lock(uri)
+		if err != nil {
+			return false, "", gl.rollback(uri, obtained, err)
+		}
+		if !memberSuccess && existing != uri {
+			slog.Info("Lock in group held by another holder, releasing the rest of the group", "lock", member.name, "current_holder", existing)
+			return false, existing, gl.rollback(uri, obtained, nil)
+		}
+		if previous != uri {
+			obtained = append(obtained, member)
+			success = true
+		}
+	}
+	if !success {
+		// every lock in the group was already held by the URI
+		return false, uri, nil
+	}
+	err := issueToken(gl.members[0].locker, gl.name, gl.tokenKey(), uri)
+	if err != nil {
+		return false, "", gl.rollback(uri, obtained, err)
+	}
+	return true, uri, nil
+}
+
+// rollback releases the locks obtained during a failed attempt to lock the group, in the reverse order they were
+// obtained
+func (gl *groupLocker) rollback(uri string, obtained []namedLocker, cause error) error {
+	var resultErr *multierror.Error
+	if cause != nil {
+		resultErr = multierror.Append(resultErr, cause)
+	}
+	for i := len(obtained) - 1; i >= 0; i-- {
+		slog.Info("Rolling back lock", "lock", obtained[i].name)
+		_, err := obtained[i].locker.Unlock(uri)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, fmt.Errorf("couldn't roll back lock '%s': %w", obtained[i].name, err))
+		}
+	}
+	return resultErr.ErrorOrNil()
+}
+
+// Unlock releases every lock in the group held by the URI. If any lock in the group is held by another URI, that URI
+// is returned along with an error.
+func (gl *groupLocker) Unlock(uri string) (string, error) {
+	var resultErr *multierror.Error
+	var otherHolder string
+	var released bool
+	for i := len(gl.members) - 1; i >= 0; i-- {
+		member := gl.members[i]
+		existing, err := member.locker.Unlock(uri)
+		if err == nil {
+			released = true
+			continue
+		}
+		if existing != "" && otherHolder == "" {
+			otherHolder = existing
+		}
+		if existing != "" {
+			resultErr = multierror.Append(resultErr, fmt.Errorf("lock '%s': %w", member.name, err))
+		}
+	}
+	if !released && otherHolder == "" {
+		return "", errors.New("couldn't unlock, no locks in the group are held")
+	}
+	return otherHolder, resultErr.ErrorOrNil()
+}
+
+// Read returns the holder of the first lock in the group that is held, or an empty string if they're all free
+func (gl *groupLocker) Read() (string, error) {
+	for _, member := range gl.members {
+		holder, err := member.locker.Read()
+		if err != nil {
+			return "", err
+		}
+		if holder != "" {
+			return holder, nil
+		}
+	}
+	return "", nil
+}
+
+// FencingToken returns the token issued when the URI obtained the group, or zero if it doesn't hold every lock in it
+func (gl *groupLocker) FencingToken(uri string) (int64, error) {
+	for _, member := range gl.members {
+		holder, err := member.locker.Read()
+		if err != nil || holder != uri {
+			return 0, err
+		}
+	}
+	return issuedTokenOf(gl.members[0].locker, gl.tokenKey(), uri)
+}
+
+func (gl *groupLocker) tokenKey() string {
+	return fmt.Sprintf("%s.token", gl.name)
+}
+
+// Expired returns the holder of a lock in the group that expired, if any
+func (gl *groupLocker) Expired() string {
+	for _, member := range gl.members {
+		if expiring, ok := member.locker.(ExpiringLocker); ok {
+			if expired := expiring.Expired(); expired != "" {
+				return expired
+			}
+		}
+	}
+	return ""
+}
+
+func (gl *groupLocker) Provider() string {
+	return gl.members[0].locker.Provider()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v55/github"
+)
+
+const (
+	modeHistory = "history"
+
+	historyAcquire = "acquire"
+	historyRefuse  = "refuse"
+	historyRelease = "release"
+	historySteal   = "steal"
+	historyExpire  = "expire"
+	historyPreempt = "preempt"
+	historyEvict   = "evict"
+	// historyRollback records that obtaining the lock was undone because the holder couldn't be labeled
+	historyRollback = "rollback"
+)
+
+// historyEntry is appended to a lock's audit log each time the lock changes hands or a request for it is refused
+type historyEntry struct {
+	Event string    `json:"event"`
+	Lock  string    `json:"lock"`
+	Actor string    `json:"actor,omitempty"`
+	PR    string    `json:"pr"`
+	SHA   string    `json:"sha,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+func (lm *LabelMutex) historyPrefix() string {
+	return fmt.Sprintf("%s.history.", lm.lock)
+}
+
+// recordHistory appends an entry describing something that happened to the PR to the lock's audit log, after the
+// expiry of the previous holder if the backend noticed one. Failing to record history is logged rather than failing
+// the run.
+func (lm *LabelMutex) recordHistory(event string, pr string) {
+	lm.recordExpired()
+	if event == historyRelease || event == historyEvict {
+		lm.measureRelease(pr)
+	}
+	lm.appendHistory(event, pr)
+}
+
+func (lm *LabelMutex) appendHistory(event string, pr string) {
+	records, ok := lm.records()
+	if !ok {
+		return
+	}
+	entry := historyEntry{
+		Event: event,
+		Lock:  lm.lock,
+		Actor: lm.sender,
+		PR:    pr,
+		At:    time.Now().UTC(),
+	}
+	if lm.holder.URL() == pr {
+		entry.SHA = lm.holder.SHA()
+	}
+	value, err := json.Marshal(entry)
+	if err == nil {
+		// zero padded so that keys sort in the order the entries were recorded
+		err = records.PutRecord(fmt.Sprintf("%s%019d", lm.historyPrefix(), entry.At.UnixNano()), value)
+	}
+	if err != nil {
+		lm.logger().Warn("Couldn't record history", "history_event", event, "error", err)
+	}
+}
+
+// recordExpired appends an entry to the lock's audit log if the backend found that the lock had expired
+func (lm *LabelMutex) recordExpired() {
+	if expiring, ok := lm.uriLocker.(ExpiringLocker); ok {
+		if expired := expiring.Expired(); expired != "" {
+			lm.recordHistory(historyExpire, expired)
+		}
+	}
+}
+
+// readHistory reads the most recent entries in the lock's audit log, newest first
+func (lm *LabelMutex) readHistory() error {
+	records, ok := lm.records()
+	if !ok {
+		return fmt.Errorf("lock '%s' doesn't support history", lm.label)
+	}
+	keys, values, err := lm.historyRecords(records)
+	if err != nil {
+		return err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	lm.history = []historyEntry{}
+	for _, key := range keys {
+		if lm.historyLimit > 0 && len(lm.history) == lm.historyLimit {
+			break
+		}
+		value, ok := values[key]
+		if !ok {
+			// stores listing keys alone are only read as far as the limit
+			value, err = records.GetRecord(key)
+			if err != nil {
+				return err
+			}
+		}
+		if value == nil {
+			continue
+		}
+		var entry historyEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			lm.logger().Warn("Ignoring unreadable history entry", "key", key, "error", err)
+			continue
+		}
+		lm.history = append(lm.history, entry)
+	}
+	return nil
+}
+
+// historyRecords lists the keys of the lock's history entries along with the entries themselves, unless the store can
+// list keys without reading each entry
+func (lm *LabelMutex) historyRecords(records recordStore) ([]string, map[string][]byte, error) {
+	if lister, ok := records.(recordKeyLister); ok {
+		keys, err := lister.ListRecordKeys(lm.historyPrefix())
+		return keys, nil, err
+	}
+	values, err := records.ListRecords(lm.historyPrefix())
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	return keys, values, nil
+}
+
+// parseSender reads the login of the user that triggered the event
+func (lm *LabelMutex) parseSender() {
+	var event struct {
+		Sender *github.User `json:"sender"`
+	}
+	if err := json.Unmarshal(lm.event, &event); err == nil {
+		lm.sender = event.Sender.GetLogin()
+	}
+}
+
+// historySummary renders a markdown table describing the lock's history
+func historySummary(mutexes []*LabelMutex) string {
+	var b strings.Builder
+	for _, lm := range mutexes {
+		if lm.history == nil {
+			continue
+		}
+		fmt.Fprintf(&b, "### History of `%s`\n\n", lm.lock)
+		b.WriteString("| When | Event | PR | Actor | SHA |\n")
+		b.WriteString("| --- | --- | --- | --- | --- |\n")
+		for _, entry := range lm.history {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n",
+				formatTime(entry.At),
+				entry.Event,
+				orDash(entry.PR),
+				orDash(entry.Actor),
+				orDash(entry.SHA),
+			)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
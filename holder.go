@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/v55/github"
+	"github.com/hashicorp/go-multierror"
+)
+
+// holder is whatever requests or holds a lock: a PR, an issue, a workflow run or anything else identified by a URL,
+// e.g. a commit. Holders that aren't PRs or issues can't be labeled, so they request the lock by being open and
+// release it by being closed.
+type holder struct {
+	htmlURL string
+	owner   string
+	repo    string
+	number  int
+	state   string
+	sha     string
+	author  string
+	labels  []string
+}
+
+// pullRequestHolder is the holder representing a PR
+func pullRequestHolder(pr *github.PullRequest) *holder {
+	h := &holder{
+		htmlURL: pr.GetHTMLURL(),
+		owner:   pr.GetBase().GetRepo().GetOwner().GetLogin(),
+		repo:    pr.GetBase().GetRepo().GetName(),
+		number:  pr.GetNumber(),
+		state:   pr.GetState(),
+		sha:     pr.GetHead().GetSHA(),
+		author:  pr.GetUser().GetLogin(),
+	}
+	for _, label := range pr.Labels {
+		h.labels = append(h.labels, label.GetName())
+	}
+	return h
+}
+
+// issueHolder is the holder representing an issue in the repository
+func issueHolder(issue *github.Issue, repo *github.Repository) *holder {
+	h := &holder{
+		htmlURL: issue.GetHTMLURL(),
+		owner:   repo.GetOwner().GetLogin(),
+		repo:    repo.GetName(),
+		number:  issue.GetNumber(),
+		state:   issue.GetState(),
+		author:  issue.GetUser().GetLogin(),
+	}
+	for _, label := range issue.Labels {
+		h.labels = append(h.labels, label.GetName())
+	}
+	return h
+}
+
+// workflowRunHolder is the holder representing a workflow run, which requests the lock until it completes
+func workflowRunHolder(run *github.WorkflowRun, label string) *holder {
+	h := &holder{
+		htmlURL: run.GetHTMLURL(),
+		owner:   run.GetRepository().GetOwner().GetLogin(),
+		repo:    run.GetRepository().GetName(),
+		state:   "open",
+		sha:     run.GetHeadSHA(),
+		author:  run.GetActor().GetLogin(),
+		labels:  []string{label},
+	}
+	if run.GetStatus() == "completed" {
+		h.state = "closed"
+	}
+	return h
+}
+
+// dispatchedHolder is the holder provided to a workflow_dispatch run by the user that triggered it, which requests
+// the lock unless the run was asked to unlock it
+func dispatchedHolder(htmlURL string, unlock bool, label string, repo *github.Repository, sender *github.User) *holder {
+	h := &holder{
+		htmlURL: htmlURL,
+		owner:   repo.GetOwner().GetLogin(),
+		repo:    repo.GetName(),
+		state:   "open",
+		author:  sender.GetLogin(),
+		labels:  []string{label},
+	}
+	if unlock {
+		h.state = "closed"
+	}
+	return h
+}
+
+// URL is the value stored in the lock while it's held by the holder
+func (h *holder) URL() string {
+	if h == nil {
+		return ""
+	}
+	return h.htmlURL
+}
+
+// Owner is the owner of the holder's repository
+func (h *holder) Owner() string {
+	if h == nil {
+		return ""
+	}
+	return h.owner
+}
+
+// Repo is the name of the holder's repository
+func (h *holder) Repo() string {
+	if h == nil {
+		return ""
+	}
+	return h.repo
+}
+
+// Number is the number of the PR or issue, or 0 if the holder can't be labeled or commented on
+func (h *holder) Number() int {
+	if h == nil {
+		return 0
+	}
+	return h.number
+}
+
+// State is 'open' while the holder may request the lock and 'closed' once it's done with it
+func (h *holder) State() string {
+	if h == nil {
+		return ""
+	}
+	return h.state
+}
+
+// SHA is the commit the holder wants to use the lock for, if any
+func (h *holder) SHA() string {
+	if h == nil {
+		return ""
+	}
+	return h.sha
+}
+
+// Author is the login of the user that created the holder
+func (h *holder) Author() string {
+	if h == nil {
+		return ""
+	}
+	return h.author
+}
+
+func (h *holder) hasLabel(name string) bool {
+	if h == nil {
+		return false
+	}
+	for _, label := range h.labels {
+		if label == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutLabel forgets a label that was removed from the holder
+func (h *holder) withoutLabel(name string) {
+	var labels []string
+	for _, label := range h.labels {
+		if label != name {
+			labels = append(labels, label)
+		}
+	}
+	h.labels = labels
+}
+
+// obtainedWithLabel is true when the holder record says the holder requested the lock with its label
+func (lm *LabelMutex) obtainedWithLabel(holder string) bool {
+	records, ok := lm.records()
+	if !ok {
+		return false
+	}
+	value, err := records.GetRecord(lm.holderKey())
+	if err != nil {
+		lm.logger().Warn("Can't read the holder record", "error", err)
+		return false
+	}
+	if len(value) == 0 {
+		return false
+	}
+	var record holderRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return false
+	}
+	return record.Holder == holder && record.Label == lm.label
+}
+
+// heldBy is true when the URI already holds the lock, including a slot of a slotted lock
+func (lm *LabelMutex) heldBy(uri string) (bool, error) {
+	current, err := lm.uriLocker.Read()
+	if err != nil {
+		return false, err
+	}
+	if current == uri {
+		return true, nil
+	}
+	if fencedLocker, ok := lm.uriLocker.(FencedLocker); ok {
+		token, err := fencedLocker.FencingToken(uri)
+		return token != 0, err
+	}
+	return false, nil
+}
+
+// parsePullRequestURL returns the owner, repository and number of the PR with the provided URL
+func parsePullRequestURL(htmlURL string) (string, string, int, error) {
+	return parseURL(htmlURL, "pull", "PR")
+}
+
+// parseIssueURL returns the owner, repository and number of the PR or issue with the provided URL
+func parseIssueURL(htmlURL string) (string, string, int, error) {
+	owner, repo, number, err := parseURL(htmlURL, "issues", "issue")
+	if err != nil {
+		return parsePullRequestURL(htmlURL)
+	}
+	return owner, repo, number, nil
+}
+
+func parseURL(htmlURL string, kind string, description string) (string, string, int, error) {
+	u, err := url.Parse(htmlURL)
+	if err != nil {
+		return "", "", 0, err
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 4 || parts[2] != kind {
+		return "", "", 0, fmt.Errorf("%s isn't the URL of a %s", htmlURL, description)
+	}
+	number, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return "", "", 0, fmt.Errorf("couldn't find a %s number in %s", description, htmlURL)
+	}
+	return parts[0], parts[1], number, nil
+}
+
+// validateHolder releases the lock if the PR holding it is closed or no longer labeled, returning the holder of the
+// lock afterwards. Only PRs that requested the lock with its label are released: holders that aren't PRs, and PRs that
+// obtained the lock some other way, e.g. through a lock group or as the holder of a workflow_dispatch run, are left
+// alone.
+func (lm *LabelMutex) validateHolder(holder string) (string, error) {
+	if holder == "" || lm.pullRequestsClient == nil || !lm.obtainedWithLabel(holder) {
+		return holder, nil
+	}
+	owner, repo, number, err := parsePullRequestURL(holder)
+	if err != nil {
+		lm.logger().Warn("Can't validate holder", "error", err)
+		return holder, nil
+	}
+	holderPR, _, err := lm.pullRequestsClient.Get(lm.context, owner, repo, number)
+	if err != nil {
+		lm.logger().Warn("Can't validate holder", "current_holder", holder, "error", err)
+		return holder, nil
+	}
+	if holderPR.GetState() == "open" && hasLabel(holderPR, lm.label) {
+		return holder, nil
+	}
+
+	lm.logger().Info("Lock held by a PR that is closed or no longer labeled, releasing", "current_holder", holder, "state", holderPR.GetState())
+	existing, err := lm.uriLocker.Unlock(holder)
+	if err != nil {
+		return existing, err
+	}
+	lm.released = true
+	lm.releasedFrom = holder
+	lm.recordHistory(historyRelease, holder)
+
+	var resultErr *multierror.Error
+	current := lm.holder
+	lm.holder = pullRequestHolder(holderPR)
+	defer func() { lm.holder = current }()
+	err = lm.deactivateDeployments()
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	err = lm.notifyWaiters(holder)
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	for _, label := range []string{lm.label, fmt.Sprintf("%s:%s", lm.label, lockedSuffix)} {
+		if !hasLabel(holderPR, label) {
+			continue
+		}
+		err = lm.removeLabel(label)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	return "", resultErr.ErrorOrNil()
+}
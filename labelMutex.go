@@ -5,41 +5,102 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/google/go-github/v55/github"
 	"github.com/hashicorp/go-multierror"
-	"github.com/wolfeidau/dynalock"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	lockedSuffix = "locked"
 )
 
+const (
+	onConflictFail   = "fail"
+	onConflictWarn   = "warn"
+	onConflictIgnore = "ignore"
+)
+
 type issuesService interface {
 	AddLabelsToIssue(ctx context.Context, owner string, repo string, number int, labels []string) ([]*github.Label, *github.Response, error)
 	RemoveLabelForIssue(ctx context.Context, owner string, repo string, number int, label string) (*github.Response, error)
+	CreateComment(ctx context.Context, owner string, repo string, number int, comment *github.IssueComment) (*github.IssueComment, *github.Response, error)
 }
 
 type pullRequestService interface {
 	List(ctx context.Context, owner string, repo string, opts *github.PullRequestListOptions) ([]*github.PullRequest, *github.Response, error)
+	Get(ctx context.Context, owner string, repo string, number int) (*github.PullRequest, *github.Response, error)
 }
 
 // LabelMutex is a GitHub action that applies a label to exactly one pull request in your repository
 type LabelMutex struct {
 	issuesClient       issuesService
 	pullRequestsClient pullRequestService
+	deploymentsClient  deploymentsService
+	teamsClient        teamsService
+	permissionsClient  permissionsService
 	context            context.Context
 	uriLocker          URILocker
+	newLocker          func(string) (URILocker, error)
+	pattern            *labelPattern
+	matches            []*LabelMutex
+	family             string
 	event              []byte
 	eventName          string
+	mode               string
+	historyLimit       int
 	label              string
+	lock               string
+	shared             bool
+	environment        string
+	onConflict         string
+	stealAllowed       []string
+	allowedRequesters  []string
+	permission         string
+	notify             string
 	action             string
-	pr                 *github.PullRequest
+	sender             string
+	holder             *holder
 	locked             bool
 	unlocked           bool
+	requested          bool
+	released           bool
+	sharedHold         bool
+	readers            []string
 	htmlURL            string
+	deploymentID       int64
+	fencingToken       int64
+	stolenFrom         string
+	stolenBy           string
+	unauthorized       string
+	repairs            []string
+	releasedFrom       string
+	fork               bool
+	holderURL          string
+	unlock             bool
+	calendar           []reservation
+	pendingReservation reservation
+	reservation        *reservation
+	reservations       []reservation
+	priority           string
+	priorities         map[string]string
+	gracePeriod        time.Duration
+	preemptedFrom      string
+	preemptAt          time.Time
+	maxHold            time.Duration
+	maxHoldWarning     time.Duration
+	evictedFrom        string
+	releases           int
+	heldFor            []time.Duration
+	waiters            []waiter
+	notified           int
+	history            []historyEntry
+	acquiredAt         time.Time
+	checkedAt          time.Time
 }
 
 func (lm *LabelMutex) output() map[string]string {
@@ -54,24 +115,233 @@ func (lm *LabelMutex) output() map[string]string {
 	} else {
 		output["unlocked"] = "false"
 	}
+	if lm.acquired() {
+		output["acquired"] = "true"
+	} else {
+		output["acquired"] = "false"
+	}
 	if lm.htmlURL != "" {
 		output["html_url"] = lm.htmlURL
 	}
+	if lm.shared {
+		if lm.sharedHold {
+			output["shared"] = "true"
+		} else {
+			output["shared"] = "false"
+		}
+		readers, _ := json.Marshal(lm.readers)
+		output["readers"] = string(readers)
+	}
+	if lm.fork {
+		output["fork"] = "true"
+	}
+	if lm.stolenFrom != "" {
+		output["stolen_from"] = lm.stolenFrom
+	}
+	if lm.preemptedFrom != "" {
+		output["preempted_from"] = lm.preemptedFrom
+	}
+	if !lm.preemptAt.IsZero() {
+		output["preempt_at"] = formatTime(lm.preemptAt)
+	}
+	if lm.evictedFrom != "" {
+		output["evicted_from"] = lm.evictedFrom
+	}
+	if lm.mode == modeHistory {
+		history, _ := json.Marshal(lm.history)
+		output["history"] = string(history)
+	}
+	if lm.mode == modeReconcile {
+		repairs, _ := json.Marshal(append([]string{}, lm.repairs...))
+		output["repairs"] = string(repairs)
+	}
+	if lm.mode == modeReserve || lm.mode == modeUnreserve {
+		reservations, _ := json.Marshal(append([]reservation{}, lm.reservations...))
+		output["reservations"] = string(reservations)
+	}
+	if lm.reservation != nil {
+		reservation, _ := json.Marshal(lm.reservation)
+		output["reservation"] = string(reservation)
+	}
+	if lm.fencingToken != 0 {
+		output["fencing_token"] = fmt.Sprintf("%d", lm.fencingToken)
+	}
+	if lm.deploymentID != 0 {
+		output["deployment_id"] = fmt.Sprintf("%d", lm.deploymentID)
+	}
 	return output
 }
 
-func (lm *LabelMutex) process() error {
-	if lm.eventName == "pull_request" {
-		return lm.processPR()
+// pullRequestEvents are the events whose payload describes a PR. pull_request_target and pull_request_review events
+// let PRs from forks request the lock, as they run with access to secrets in the context of the base repository.
+var pullRequestEvents = map[string]bool{
+	"pull_request":        true,
+	"pull_request_target": true,
+	"pull_request_review": true,
+}
+
+// isFork is true when the head of the PR lives in a different repository than its base. PRs whose head repository
+// has been deleted are treated as forks.
+func isFork(pr *github.PullRequest) bool {
+	return pr.GetHead().GetRepo() == nil || pr.GetHead().GetRepo().GetID() != pr.GetBase().GetRepo().GetID()
+}
+
+// acquired is true when the current holder holds the lock
+func (lm *LabelMutex) acquired() bool {
+	return lm.locked && lm.holder != nil && lm.htmlURL == lm.holder.URL()
+}
+
+// failed is true when the lock was refused and conflicts should fail the run
+func (lm *LabelMutex) failed() bool {
+	return lm.onConflict == onConflictFail && lm.refusal() != ""
+}
+
+func (lm *LabelMutex) process() (err error) {
+	if lm.context == nil {
+		lm.context = context.Background()
+	}
+	ctx, span := tracer.Start(lm.context, "LabelMutex.process", trace.WithAttributes(
+		attribute.String("lock.label", lm.label),
+		attribute.String("lock.name", lm.lock),
+		attribute.String("lock.mode", lm.mode),
+		attribute.String("github.event", lm.eventName),
+	))
+	defer func() { endSpan(span, err) }()
+	lm.context = ctx
+	traceLocker(lm.uriLocker, ctx)
+	lm.checkedAt = time.Now()
+	lm.parseSender()
+	defer lm.recordExpired()
+	if lm.mode == modeHistory {
+		if lm.pattern != nil {
+			lm.logger().Info("Locks controlled by a label pattern don't have a single history, doing nothing")
+			return nil
+		}
+		return lm.readHistory()
+	}
+	if lm.mode == modeReconcile {
+		return lm.reconcile()
+	}
+	if lm.mode == modeReserve || lm.mode == modeUnreserve {
+		if lm.pattern != nil {
+			lm.logger().Info("Locks controlled by a label pattern can't be reserved, doing nothing")
+			return nil
+		}
+		if lm.mode == modeUnreserve {
+			return lm.unreserve()
+		}
+		return lm.reserve()
+	}
+	if lm.pattern != nil {
+		return lm.processPattern()
+	}
+	switch {
+	case pullRequestEvents[lm.eventName]:
+		err = lm.processPR()
+	case lm.eventName == "issues":
+		err = lm.processIssue()
+	case lm.eventName == "workflow_run":
+		err = lm.processWorkflowRun()
+	case lm.eventName == "workflow_dispatch" && lm.holderURL != "":
+		err = lm.processDispatch()
+	case lm.eventName == "merge_group":
+		err = lm.processMergeGroup()
+	default:
+		err = lm.processOther()
+	}
+	if err != nil {
+		return err
+	}
+	err = lm.readFencingToken()
+	if err != nil {
+		return err
+	}
+	lm.loadWaiters()
+	return nil
+}
+
+// readFencingToken reads the fencing token issued to the holder of the lock. PRs only see their own token.
+func (lm *LabelMutex) readFencingToken() error {
+	fenced, ok := lm.uriLocker.(FencedLocker)
+	if !ok || !lm.locked || lm.htmlURL == "" || (lm.holder != nil && !lm.acquired()) {
+		return nil
 	}
-	return lm.processOther()
+	token, err := fenced.FencingToken(lm.htmlURL)
+	if err != nil {
+		return err
+	}
+	lm.fencingToken = token
+	return nil
+}
+
+// mutexes returns the LabelMutex for each lock evaluated while processing the event
+func (lm *LabelMutex) mutexes() []*LabelMutex {
+	if lm.pattern != nil {
+		return lm.matches
+	}
+	return []*LabelMutex{lm}
+}
+
+// processPattern processes the event once for each label on the PR that matches the pattern, using the lock named by
+// that label
+func (lm *LabelMutex) processPattern() error {
+	if !pullRequestEvents[lm.eventName] {
+		lm.logger().Info("Label patterns can only be evaluated against pull request events, doing nothing")
+		return nil
+	}
+	var pr github.PullRequestEvent
+	err := json.Unmarshal(lm.event, &pr)
+	if err != nil {
+		return err
+	}
+	labels := pr.GetPullRequest().Labels
+	if pr.GetAction() == "unlabeled" {
+		labels = append(labels, pr.GetLabel())
+	}
+
+	var resultErr *multierror.Error
+	seen := make(map[string]bool)
+	for _, label := range labels {
+		name, ok := lm.pattern.lockName(label.GetName())
+		if !ok || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if lm.lock != "" {
+			name = fmt.Sprintf("%s-%s", lm.lock, name)
+		}
+		lm.logger().Info("Label matches pattern", "match", label.GetName(), "match_lock", name)
+		uriLocker, err := lm.newLocker(name)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+			continue
+		}
+		match := *lm
+		match.pattern = nil
+		match.family = lm.label
+		match.label = label.GetName()
+		match.lock = name
+		match.uriLocker = uriLocker
+		err = match.process()
+		if err != nil {
+			resultErr = multierror.Append(resultErr, fmt.Errorf("%s: %w", name, err))
+		}
+		lm.matches = append(lm.matches, &match)
+	}
+	return resultErr.ErrorOrNil()
 }
 
 func (lm *LabelMutex) processOther() error {
+	if sharedLocker, ok := lm.uriLocker.(SharedLocker); ok && lm.shared {
+		return lm.readShared(sharedLocker)
+	}
 	value, err := lm.uriLocker.Read()
-	if err == dynalock.ErrKeyNotFound {
-		lm.locked = false
-		lm.unlocked = true
+	if err != nil {
+		return err
+	}
+	value, err = lm.validateHolder(value)
+	if err != nil {
+		return err
 	}
 	if value == "" {
 		lm.locked = false
@@ -84,117 +354,307 @@ func (lm *LabelMutex) processOther() error {
 	return nil
 }
 
+// addLabels adds labels to the holder unless it can't be labeled
+func (lm *LabelMutex) addLabels(labels ...string) error {
+	if lm.holder.Number() == 0 {
+		return nil
+	}
+	_, _, err := lm.issuesClient.AddLabelsToIssue(lm.context, lm.holder.Owner(), lm.holder.Repo(), lm.holder.Number(), labels)
+	return err
+}
+
+// removeLabel removes a label from the holder, ignoring labels that aren't present
+func (lm *LabelMutex) removeLabel(name string) error {
+	return lm.removeLabelFrom(lm.holder.Number(), name)
+}
+
+// removeLabelFrom removes a label from a PR or issue in the repository of the holder, ignoring labels that aren't
+// present and holders that can't be labeled
+func (lm *LabelMutex) removeLabelFrom(number int, name string) error {
+	if number == 0 {
+		return nil
+	}
+	resp, err := lm.issuesClient.RemoveLabelForIssue(lm.context, lm.holder.Owner(), lm.holder.Repo(), number, name)
+	if resp != nil && resp.Response.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// processPR reads the PR that triggered a pull request event and processes it
 func (lm *LabelMutex) processPR() error {
-	var resultErr *multierror.Error
 	var pr github.PullRequestEvent
 	err := json.Unmarshal(lm.event, &pr)
 	if err != nil {
 		return err
 	}
-	lm.pr = pr.GetPullRequest()
-	lm.action = pr.GetAction()
+	lm.holder = pullRequestHolder(pr.GetPullRequest())
+	lm.fork = isFork(pr.GetPullRequest())
+	return lm.processHolder(pr.GetAction(), pr.GetLabel().GetName(), pr.GetSender().GetLogin())
+}
 
-	var hasLockRequestLabel bool
-	var hasLockConfirmedLabel bool
-	for _, label := range lm.pr.Labels {
-		if lm.label == label.GetName() {
-			hasLockRequestLabel = true
-		}
-		if fmt.Sprintf("%s:%s", lm.label, lockedSuffix) == label.GetName() {
-			hasLockConfirmedLabel = true
-		}
+// processIssue reads the issue that triggered an issues event and processes it
+func (lm *LabelMutex) processIssue() error {
+	var event github.IssuesEvent
+	err := json.Unmarshal(lm.event, &event)
+	if err != nil {
+		return err
 	}
+	lm.holder = issueHolder(event.GetIssue(), event.GetRepo())
+	return lm.processHolder(event.GetAction(), event.GetLabel().GetName(), event.GetSender().GetLogin())
+}
+
+// processWorkflowRun obtains the lock on behalf of the workflow run that triggered a workflow_run event, releasing it
+// once the run completes
+func (lm *LabelMutex) processWorkflowRun() error {
+	var event github.WorkflowRunEvent
+	err := json.Unmarshal(lm.event, &event)
+	if err != nil {
+		return err
+	}
+	run := event.GetWorkflowRun()
+	lm.holder = workflowRunHolder(run, lm.label)
+	lm.fork = run.GetHeadRepository() != nil && run.GetHeadRepository().GetID() != run.GetRepository().GetID()
+	authorized, err := lm.authorized(event.GetSender().GetLogin())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return lm.refuseRun(event.GetSender().GetLogin())
+	}
+	return lm.processHolder(event.GetAction(), "", event.GetSender().GetLogin())
+}
+
+// processDispatch obtains the lock on behalf of the holder provided to a workflow_dispatch run, or releases it when
+// the run was asked to unlock it
+func (lm *LabelMutex) processDispatch() error {
+	var event github.WorkflowDispatchEvent
+	err := json.Unmarshal(lm.event, &event)
+	if err != nil {
+		return err
+	}
+	lm.holder = dispatchedHolder(lm.holderURL, lm.unlock, lm.label, event.GetRepo(), event.GetSender())
+	authorized, err := lm.authorized(event.GetSender().GetLogin())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return lm.refuseRun(event.GetSender().GetLogin())
+	}
+	return lm.processHolder("", "", event.GetSender().GetLogin())
+}
+
+// processHolder obtains or releases the lock on behalf of the holder according to its state and labels. label is the
+// label that was added or removed by the event, if any.
+func (lm *LabelMutex) processHolder(action string, label string, sender string) error {
+	var resultErr *multierror.Error
+	lm.action = action
+
+	hasLockRequestLabel := lm.holder.hasLabel(lm.label)
+	hasLockConfirmedLabel := lm.holder.hasLabel(fmt.Sprintf("%s:%s", lm.label, lockedSuffix))
+	hasSharedRequestLabel := lm.holder.hasLabel(lm.sharedLabel())
+	hasSharedConfirmedLabel := lm.holder.hasLabel(fmt.Sprintf("%s:%s", lm.sharedLabel(), lockedSuffix))
+	hasStealLabel := lm.holder.hasLabel(lm.stealLabel())
 
 	var removedLabelName string
 	var lockLabelRemoved bool
+	var sharedLabelRemoved bool
 	if lm.action == "unlabeled" {
-		removedLabelName = pr.GetLabel().GetName()
+		removedLabelName = label
 		if removedLabelName == lm.label {
 			lockLabelRemoved = true
 		}
+		if removedLabelName == lm.sharedLabel() {
+			sharedLabelRemoved = true
+		}
+	}
+
+	if lm.action == "labeled" && (label == lm.label || label == lm.sharedLabel()) {
+		authorized, err := lm.authorized(sender)
+		if err != nil {
+			return err
+		}
+		if !authorized {
+			return lm.refuseRequest(sender, label)
+		}
+	}
+	if lm.action == "labeled" && strings.HasPrefix(label, lm.priorityLabelPrefix()) {
+		allowed, err := lm.mayPrioritize(sender, strings.TrimPrefix(label, lm.priorityLabelPrefix()))
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			err = lm.refusePriority(sender, label)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	lockValue := lm.pr.GetHTMLURL()
-	if lm.pr.GetState() != "open" || lockLabelRemoved {
-		log.Printf("Unlocking '%s' ...\n", lm.label)
+	// the wake label has done its job by running the holder's workflows, and is removed so that it can wake it again
+	if lm.holder.hasLabel(lm.wakeLabel()) {
+		err := lm.removeLabel(lm.wakeLabel())
+		if err != nil {
+			lm.logger().Warn("Couldn't remove wake label", "error", err)
+		}
+	}
+
+	lockValue := lm.holder.URL()
+	if sharedLocker, ok := lm.uriLocker.(SharedLocker); ok && lm.shared {
+		if lm.holder.State() != "open" || sharedLabelRemoved {
+			err := lm.releaseShared(sharedLocker)
+			if err != nil {
+				resultErr = multierror.Append(resultErr, err)
+			}
+			if lm.holder.State() == "open" {
+				return multierror.Append(resultErr, lm.readShared(sharedLocker)).ErrorOrNil()
+			}
+		} else if hasSharedRequestLabel && !hasLockRequestLabel {
+			return lm.obtainShared(sharedLocker, hasSharedConfirmedLabel)
+		}
+	}
+	if lm.holder.State() != "open" || lockLabelRemoved {
+		lm.logger().Info("Unlocking")
 		existing, err := lm.uriLocker.Unlock(lockValue)
 		if err == nil || existing == "" {
-			log.Println("Unlocked!")
+			lm.logger().Info("Unlocked")
 			lm.locked = false
 			lm.unlocked = true
+			lm.released = err == nil
 		}
 		if existing == "" {
-			if lm.action == "unlabeled" || lm.action == "closed" {
+			// workflow runs complete and dispatched holders are unlocked rather than closing
+			if lm.action == "unlabeled" || lm.action == "closed" || lm.action == "completed" || lm.unlock {
 				lm.locked = false
 				lm.unlocked = true
-				log.Printf("Lock '%s' was already unlocked  ...\n", lm.label)
+				lm.logger().Info("Lock was already unlocked")
 			} else {
 				resultErr = multierror.Append(resultErr, err)
 			}
 		} else {
 			lm.locked = true
 			lm.unlocked = false
-			log.Printf("Lock '%s' currently claimed by %s  ...\n", lm.label, existing)
+			lm.logger().Info("Lock claimed by another holder", "current_holder", existing)
 			lm.htmlURL = existing
 		}
 
-		resp, err := lm.issuesClient.RemoveLabelForIssue(lm.context, lm.pr.GetBase().Repo.Owner.GetLogin(), lm.pr.GetBase().Repo.GetName(), lm.pr.GetNumber(), lm.label)
-		if resp.Response.StatusCode != http.StatusNotFound && err != nil {
+		if lm.unlocked {
+			err = lm.deactivateDeployments()
+			if err != nil {
+				resultErr = multierror.Append(resultErr, err)
+			}
+		}
+
+		err = lm.removeWaiter()
+		if err != nil {
 			resultErr = multierror.Append(resultErr, err)
 		}
+		if lm.released {
+			lm.recordHistory(historyRelease, lockValue)
+			err = lm.notifyWaiters(lockValue)
+			if err != nil {
+				resultErr = multierror.Append(resultErr, err)
+			}
+		}
 
-		resp, err = lm.issuesClient.RemoveLabelForIssue(lm.context, lm.pr.GetBase().Repo.Owner.GetLogin(), lm.pr.GetBase().Repo.GetName(), lm.pr.GetNumber(), fmt.Sprintf("%s:%s", lm.label, lockedSuffix))
-		if resp.Response.StatusCode != http.StatusNotFound && err != nil {
+		err = lm.removeLabel(lm.label)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+
+		err = lm.removeLabel(fmt.Sprintf("%s:%s", lm.label, lockedSuffix))
+		if err != nil {
 			resultErr = multierror.Append(resultErr, err)
 		}
 
 		return resultErr.ErrorOrNil()
 	}
 
+	if hasStealLabel {
+		return lm.steal(sender)
+	}
 	if hasLockRequestLabel && hasLockConfirmedLabel {
-		log.Printf("Lock '%s' should already be claimed by %s, confirming  ...\n", lm.label, lockValue)
+		lm.logger().Info("Lock should already be held, confirming")
+		lm.requested = true
 
-		// double check
+		// double check. Some backends report success when the holder locks again, so whether the lock was free is read
+		// first to only record an acquisition when the holder had actually lost it.
+		held, err := lm.heldBy(lockValue)
+		if err != nil {
+			return err
+		}
 		success, existingValue, lockErr := lm.uriLocker.Lock(lockValue)
-		if success {
+		if success && !held {
 			lm.locked = true
 			lm.htmlURL = lockValue
-			log.Printf("Weird, the lock should have already been ours!")
-			return nil
+			lm.acquiredAt = time.Now()
+			lm.recordHistory(historyAcquire, lockValue)
+			lm.logger().Warn("Lock should already have been held")
+			return lm.ensureDeployment()
 		}
-		if existingValue == lockValue {
+		if success || existingValue == lockValue {
 			lm.locked = true
 			lm.htmlURL = lockValue
-			return nil
+			return lm.ensureDeployment()
 		}
 		return lockErr
 	}
 	if hasLockRequestLabel && !hasLockConfirmedLabel {
-		log.Printf("Lock '%s' requested but not confirmed, trying to lock with %s  ...\n", lm.label, lockValue)
+		lm.logger().Info("Lock requested but not confirmed, locking")
+		lm.requested = true
+		reservation := lm.reserved(lockValue)
+		if reservation != nil {
+			return lm.refuseReserved(reservation)
+		}
+		if lm.maxHold > 0 {
+			current, err := lm.uriLocker.Read()
+			if err != nil {
+				return err
+			}
+			if current != lockValue {
+				_, err = lm.enforceMaxHold(current)
+				if err != nil {
+					return err
+				}
+			}
+		}
 		success, existingValue, lockErr := lm.uriLocker.Lock(lockValue)
 		if lockErr != nil {
 			return lockErr
 		}
 		if success {
-			log.Printf("Lock '%s' obtained\n", lm.label)
+			lm.logger().Info("Lock obtained")
 			lm.locked = true
 			lm.htmlURL = lockValue
-			labelsToAdd := []string{fmt.Sprintf("%s:%s", lm.label, lockedSuffix)}
-			_, _, err := lm.issuesClient.AddLabelsToIssue(lm.context, lm.pr.GetBase().Repo.Owner.GetLogin(), lm.pr.GetBase().Repo.GetName(), lm.pr.GetNumber(), labelsToAdd)
+			lm.acquiredAt = time.Now()
+			lm.recordHistory(historyAcquire, lockValue)
+			err := lm.confirmAcquisition(lockValue, "", fmt.Sprintf("%s:%s", lm.label, lockedSuffix))
 			if err != nil {
 				return err
 			}
-			return nil
+			err = lm.removeWaiter()
+			if err != nil {
+				return err
+			}
+			return lm.ensureDeployment()
 		}
 		if existingValue != "" {
-			log.Printf("Lock '%s' claimed by %s\n", lm.label, existingValue)
+			lm.logger().Info("Lock claimed by another holder", "current_holder", existingValue)
 			lm.locked = true
 			lm.htmlURL = existingValue
+			if existingValue != lockValue {
+				preempted, err := lm.preempt(existingValue)
+				if err != nil || preempted {
+					return err
+				}
+				lm.recordHistory(historyRefuse, lockValue)
+				return lm.addWaiter()
+			}
 			return nil
 		}
 		return errors.New("Unknown error")
 	}
 
-	log.Printf("Label '%s' not present, doing nothing\n", lm.label)
+	lm.logger().Info("Label not present, doing nothing")
 	return resultErr.ErrorOrNil()
 }
@@ -1,17 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 
 	"github.com/google/go-github/v55/github"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sethvargo/go-githubactions"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 var (
@@ -31,6 +48,60 @@ func (c *happyPathLabelClient) AddLabelsToIssue(ctx context.Context, owner strin
 func (c *happyPathLabelClient) RemoveLabelForIssue(ctx context.Context, owner string, repo string, number int, label string) (*github.Response, error) {
 	return http200, nil
 }
+func (c *happyPathLabelClient) CreateComment(ctx context.Context, owner string, repo string, number int, comment *github.IssueComment) (*github.IssueComment, *github.Response, error) {
+	return comment, http200, nil
+}
+
+// recordingLabelClient records the labels and comments added to each PR
+type recordingLabelClient struct {
+	added    map[int][]string
+	removed  map[int][]string
+	comments map[int][]string
+}
+
+func newRecordingLabelClient() *recordingLabelClient {
+	return &recordingLabelClient{
+		added:    make(map[int][]string),
+		removed:  make(map[int][]string),
+		comments: make(map[int][]string),
+	}
+}
+
+func (c *recordingLabelClient) AddLabelsToIssue(ctx context.Context, owner string, repo string, number int, labels []string) ([]*github.Label, *github.Response, error) {
+	c.added[number] = append(c.added[number], labels...)
+	return nil, http200, nil
+}
+func (c *recordingLabelClient) RemoveLabelForIssue(ctx context.Context, owner string, repo string, number int, label string) (*github.Response, error) {
+	c.removed[number] = append(c.removed[number], label)
+	return http200, nil
+}
+func (c *recordingLabelClient) CreateComment(ctx context.Context, owner string, repo string, number int, comment *github.IssueComment) (*github.IssueComment, *github.Response, error) {
+	c.comments[number] = append(c.comments[number], comment.GetBody())
+	return comment, http200, nil
+}
+
+// failingLabelClient fails to add labels to PRs, as when GitHub keeps erroring after retries
+type failingLabelClient struct {
+	*recordingLabelClient
+}
+
+func (c *failingLabelClient) AddLabelsToIssue(ctx context.Context, owner string, repo string, number int, labels []string) ([]*github.Label, *github.Response, error) {
+	return nil, &github.Response{Response: &http.Response{StatusCode: http.StatusBadGateway}}, errors.New("502 Bad Gateway")
+}
+
+// fakeTeamsClient reports the logins in members as active members of each 'org/team-slug'
+type fakeTeamsClient struct {
+	members map[string][]string
+}
+
+func (c *fakeTeamsClient) GetTeamMembershipBySlug(ctx context.Context, org string, slug string, user string) (*github.Membership, *github.Response, error) {
+	for _, member := range c.members[org+"/"+slug] {
+		if member == user {
+			return &github.Membership{State: github.String("active")}, http200, nil
+		}
+	}
+	return nil, http404, errors.New("not found")
+}
 
 type racyMockLocker struct {
 	value string
@@ -60,8 +131,40 @@ func (l *racyMockLocker) Provider() string {
 	return "racyMockLocker"
 }
 
+// memoryLocker behaves like the real lockers without needing a backend
+type memoryLocker struct {
+	value string
+}
+
+func (l *memoryLocker) Lock(v string) (bool, string, error) {
+	if l.value == "" {
+		l.value = v
+		return true, v, nil
+	}
+	return false, l.value, nil
+}
+
+func (l *memoryLocker) Unlock(v string) (string, error) {
+	if l.value == "" {
+		return "", errors.New("lock not found")
+	}
+	if l.value != v {
+		return l.value, fmt.Errorf("couldn't unlock with provided value of %s, lock currently held by %s", v, l.value)
+	}
+	l.value = ""
+	return "", nil
+}
+
+func (l *memoryLocker) Read() (string, error) {
+	return l.value, nil
+}
+
+func (l *memoryLocker) Provider() string {
+	return "memoryLocker"
+}
+
 func uuidLocker() URILocker {
-	localDynamoLocker, err := NewDynamoURILocker("label-mutex", "staging", fmt.Sprintf("%v", uuid.New()))
+	localDynamoLocker, err := NewDynamoURILocker("label-mutex", "staging", fmt.Sprintf("%v", uuid.New()), 0)
 	if err != nil {
 		panic(err)
 	}
@@ -69,7 +172,7 @@ func uuidLocker() URILocker {
 }
 
 func gcsUUIDLocker() URILocker {
-	localGCSLocker, err := NewGCSLocker("label-mutex", fmt.Sprintf("%v", uuid.New()))
+	localGCSLocker, err := NewGCSLocker("label-mutex", fmt.Sprintf("%v", uuid.New()), 0)
 	if err != nil {
 		panic(err)
 	}
@@ -86,6 +189,7 @@ type labelMutexTest struct {
 	locked         bool
 	lockedOutput   string
 	unlockedOutput string
+	acquiredOutput string
 	htmlURLOutput  string
 }
 
@@ -107,6 +211,7 @@ func init() {
 				locked:         false,
 				lockedOutput:   "false",
 				unlockedOutput: "true",
+				acquiredOutput: "false",
 				htmlURLOutput:  "",
 			},
 			{
@@ -119,6 +224,7 @@ func init() {
 				locked:         false,
 				lockedOutput:   "false",
 				unlockedOutput: "false",
+				acquiredOutput: "false",
 				htmlURLOutput:  "",
 			},
 			{
@@ -131,6 +237,7 @@ func init() {
 				locked:         true,
 				lockedOutput:   "true",
 				unlockedOutput: "false",
+				acquiredOutput: "true",
 				htmlURLOutput:  "https://github.com/urcomputeringpal/label-mutex/pull/1",
 			},
 			// add the label and obtain the lock
@@ -144,6 +251,7 @@ func init() {
 				locked:         true,
 				lockedOutput:   "true",
 				unlockedOutput: "false",
+				acquiredOutput: "true",
 				htmlURLOutput:  "https://github.com/urcomputeringpal/label-mutex/pull/1",
 			},
 			// add the label again
@@ -157,6 +265,7 @@ func init() {
 				locked:         true,
 				lockedOutput:   "true",
 				unlockedOutput: "false",
+				acquiredOutput: "true",
 				htmlURLOutput:  "https://github.com/urcomputeringpal/label-mutex/pull/1",
 			},
 			// try to clobber it
@@ -170,6 +279,7 @@ func init() {
 				locked:         true,
 				lockedOutput:   "true",
 				unlockedOutput: "false",
+				acquiredOutput: "false",
 				htmlURLOutput:  "https://github.com/urcomputeringpal/label-mutex/pull/1",
 			},
 			// sync the pr
@@ -183,6 +293,7 @@ func init() {
 				locked:         true,
 				lockedOutput:   "true",
 				unlockedOutput: "false",
+				acquiredOutput: "true",
 				htmlURLOutput:  "https://github.com/urcomputeringpal/label-mutex/pull/1",
 			},
 			// try to read it
@@ -196,6 +307,7 @@ func init() {
 				locked:         true,
 				lockedOutput:   "true",
 				unlockedOutput: "false",
+				acquiredOutput: "false",
 				htmlURLOutput:  "https://github.com/urcomputeringpal/label-mutex/pull/1",
 			},
 			// try to remove it from a PR that doesn't have it
@@ -209,6 +321,7 @@ func init() {
 				locked:         true,
 				lockedOutput:   "true",
 				unlockedOutput: "false",
+				acquiredOutput: "false",
 				htmlURLOutput:  "https://github.com/urcomputeringpal/label-mutex/pull/1",
 			},
 			// close to remove the first lock
@@ -222,6 +335,7 @@ func init() {
 				locked:         false,
 				lockedOutput:   "false",
 				unlockedOutput: "true",
+				acquiredOutput: "false",
 				htmlURLOutput:  "",
 			},
 			// Can lock and unlock if given a totally different locker
@@ -235,6 +349,7 @@ func init() {
 				locked:         true,
 				lockedOutput:   "true",
 				unlockedOutput: "false",
+				acquiredOutput: "true",
 				htmlURLOutput:  "https://github.com/urcomputeringpal/label-mutex/pull/1",
 			},
 			{
@@ -247,6 +362,7 @@ func init() {
 				locked:         false,
 				lockedOutput:   "false",
 				unlockedOutput: "true",
+				acquiredOutput: "false",
 				htmlURLOutput:  "",
 			},
 			// close without a lock
@@ -260,6 +376,7 @@ func init() {
 				locked:         false,
 				lockedOutput:   "false",
 				unlockedOutput: "true",
+				acquiredOutput: "false",
 				htmlURLOutput:  "",
 			},
 		}
@@ -304,9 +421,2296 @@ func TestTable(t *testing.T) {
 			if output["unlocked"] != tt.unlockedOutput {
 				t.Errorf("%s (%s): outputs.unlocked: got %v, want %v", tt.eventFilename, tt.uriLocker.Provider(), output["unlocked"], tt.unlockedOutput)
 			}
+			if output["acquired"] != tt.acquiredOutput {
+				t.Errorf("%s (%s): outputs.acquired: got %v, want %v", tt.eventFilename, tt.uriLocker.Provider(), output["acquired"], tt.acquiredOutput)
+			}
 			if output["html_url"] != tt.htmlURLOutput {
 				t.Errorf("%s (%s): outputs.html_url: got %v, want %v", tt.eventFilename, tt.uriLocker.Provider(), output["html_url"], tt.htmlURLOutput)
 			}
 		})
 	}
 }
+
+type fakeDeploymentsClient struct {
+	deployments []*github.Deployment
+	statuses    map[int64][]string
+}
+
+func (c *fakeDeploymentsClient) ListDeployments(ctx context.Context, owner, repo string, opts *github.DeploymentsListOptions) ([]*github.Deployment, *github.Response, error) {
+	var deployments []*github.Deployment
+	for _, d := range c.deployments {
+		if d.GetEnvironment() != opts.Environment || d.GetTask() != opts.Task {
+			continue
+		}
+		if opts.SHA != "" && d.GetSHA() != opts.SHA {
+			continue
+		}
+		deployments = append(deployments, d)
+	}
+	resp := &github.Response{Response: &http.Response{StatusCode: 200}}
+	if opts.PerPage > 0 {
+		page := opts.Page
+		if page == 0 {
+			page = 1
+		}
+		start := (page - 1) * opts.PerPage
+		if start > len(deployments) {
+			start = len(deployments)
+		}
+		end := start + opts.PerPage
+		if end < len(deployments) {
+			resp.NextPage = page + 1
+		} else {
+			end = len(deployments)
+		}
+		deployments = deployments[start:end]
+	}
+	return deployments, resp, nil
+}
+
+// ListDeploymentStatuses lists the statuses of a deployment newest first, like GitHub
+func (c *fakeDeploymentsClient) ListDeploymentStatuses(ctx context.Context, owner, repo string, deployment int64, opts *github.ListOptions) ([]*github.DeploymentStatus, *github.Response, error) {
+	var statuses []*github.DeploymentStatus
+	for i := len(c.statuses[deployment]) - 1; i >= 0; i-- {
+		statuses = append(statuses, &github.DeploymentStatus{State: github.String(c.statuses[deployment][i])})
+	}
+	return statuses, http200, nil
+}
+
+func (c *fakeDeploymentsClient) CreateDeployment(ctx context.Context, owner, repo string, request *github.DeploymentRequest) (*github.Deployment, *github.Response, error) {
+	payload, err := json.Marshal(request.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := &github.Deployment{
+		ID:          github.Int64(int64(len(c.deployments) + 1)),
+		SHA:         request.Ref,
+		Task:        request.Task,
+		Environment: request.Environment,
+		Payload:     payload,
+	}
+	c.deployments = append(c.deployments, d)
+	return d, http200, nil
+}
+
+func (c *fakeDeploymentsClient) CreateDeploymentStatus(ctx context.Context, owner, repo string, deployment int64, request *github.DeploymentStatusRequest) (*github.DeploymentStatus, *github.Response, error) {
+	if c.statuses == nil {
+		c.statuses = make(map[int64][]string)
+	}
+	c.statuses[deployment] = append(c.statuses[deployment], request.GetState())
+	return &github.DeploymentStatus{State: request.State}, http200, nil
+}
+
+func TestDeploymentsAcrossCommits(t *testing.T) {
+	deployments := &fakeDeploymentsClient{}
+	// deployments of other PRs push the PR's own deployments onto a second page
+	for i := 0; i < 150; i++ {
+		_, _, err := deployments.CreateDeployment(context.Background(), "urcomputeringpal", "label-mutex", &github.DeploymentRequest{
+			Ref:         github.String("0000000"),
+			Task:        github.String(deploymentTask),
+			Environment: github.String("staging"),
+			Payload:     deploymentPayload{HTMLURL: "https://github.com/urcomputeringpal/label-mutex/pull/99"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pushed := eventWithLabels(t, "testdata/1/pull_request.synchronize_with_labels.json", "staging", "staging:locked")
+	var event map[string]any
+	if err := json.Unmarshal(pushed, &event); err != nil {
+		t.Fatal(err)
+	}
+	event["pull_request"].(map[string]any)["head"].(map[string]any)["sha"] = "1111111"
+	pushed, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locker := &racyMockLocker{}
+	steps := []struct {
+		name         string
+		event        []byte
+		deploymentID string
+		statuses     map[int64][]string
+	}{
+		{"obtained", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), "151", map[int64][]string{151: {"in_progress"}}},
+		{"new commit", pushed, "152", map[int64][]string{151: {"in_progress", "inactive"}, 152: {"in_progress"}}},
+		{"released", eventWithLabels(t, "testdata/1/pull_request.closed.json", "staging", "staging:locked"), "", map[int64][]string{151: {"in_progress", "inactive"}, 152: {"in_progress", "inactive"}}},
+	}
+	for _, step := range steps {
+		lm := &LabelMutex{
+			context:           context.Background(),
+			issuesClient:      &happyPathLabelClient{},
+			deploymentsClient: deployments,
+			uriLocker:         locker,
+			event:             step.event,
+			eventName:         "pull_request",
+			label:             "staging",
+			environment:       "staging",
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", step.name, err)
+		}
+		if got := lm.output()["deployment_id"]; got != step.deploymentID {
+			t.Errorf("%s: outputs.deployment_id: got %v, want %v", step.name, got, step.deploymentID)
+		}
+		if !reflect.DeepEqual(deployments.statuses, step.statuses) {
+			t.Errorf("%s: statuses: got %v, want %v", step.name, deployments.statuses, step.statuses)
+		}
+	}
+}
+
+func TestDeployments(t *testing.T) {
+	locker := &racyMockLocker{}
+	deployments := &fakeDeploymentsClient{}
+	steps := []struct {
+		eventFilename string
+		deploymentID  string
+		statuses      []string
+	}{
+		{"testdata/1/pull_request.labeled.json", "1", []string{"in_progress"}},
+		{"testdata/1/pull_request.synchronize_with_labels.json", "1", []string{"in_progress"}},
+		{"testdata/1/pull_request.closed.json", "", []string{"in_progress", "inactive"}},
+		{"testdata/1/pull_request.labeled.json", "1", []string{"in_progress", "inactive", "in_progress"}},
+		{"testdata/1/pull_request.synchronize_with_labels.json", "1", []string{"in_progress", "inactive", "in_progress"}},
+	}
+	for _, step := range steps {
+		event, err := os.ReadFile(step.eventFilename)
+		if err != nil {
+			t.Fatalf("%s: %+v", step.eventFilename, err)
+		}
+		lm := &LabelMutex{
+			context:           context.Background(),
+			issuesClient:      &happyPathLabelClient{},
+			deploymentsClient: deployments,
+			uriLocker:         locker,
+			event:             event,
+			eventName:         "pull_request",
+			label:             "staging",
+			environment:       "staging",
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", step.eventFilename, err)
+		}
+		if got := lm.output()["deployment_id"]; got != step.deploymentID {
+			t.Errorf("%s: outputs.deployment_id: got %v, want %v", step.eventFilename, got, step.deploymentID)
+		}
+		if len(deployments.deployments) != 1 {
+			t.Fatalf("%s: got %d deployments, want 1", step.eventFilename, len(deployments.deployments))
+		}
+		if got := deployments.statuses[1]; !reflect.DeepEqual(got, step.statuses) {
+			t.Errorf("%s: statuses: got %v, want %v", step.eventFilename, got, step.statuses)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	locker := &memoryLocker{}
+	steps := []struct {
+		eventFilename string
+		onConflict    string
+		annotation    string
+		row           string
+		failed        bool
+	}{
+		{"testdata/1/pull_request.labeled.json", onConflictWarn, "::notice::Lock on staging held by https://github.com/urcomputeringpal/label-mutex/pull/1", "| `staging` | https://github.com/urcomputeringpal/label-mutex/pull/1 | locked | - |", false},
+		{"testdata/2/pull_request.labeled.json", onConflictWarn, "::warning::Couldn't obtain a lock on staging. Someone may already be using it: https://github.com/urcomputeringpal/label-mutex/pull/1", "| `staging` | https://github.com/urcomputeringpal/label-mutex/pull/1 | held by another PR | - | - |", false},
+		{"testdata/2/pull_request.labeled.json", onConflictFail, "::error::Couldn't obtain a lock on staging. Someone may already be using it: https://github.com/urcomputeringpal/label-mutex/pull/1", "| `staging` | https://github.com/urcomputeringpal/label-mutex/pull/1 | held by another PR |", true},
+		{"testdata/1/pull_request.closed.json", onConflictFail, "::notice::Lock on staging released", "| `staging` | - | unlocked | - | - |", false},
+	}
+	for _, step := range steps {
+		event, err := os.ReadFile(step.eventFilename)
+		if err != nil {
+			t.Fatalf("%s: %+v", step.eventFilename, err)
+		}
+		lm := &LabelMutex{
+			context:      context.Background(),
+			issuesClient: &happyPathLabelClient{},
+			uriLocker:    locker,
+			event:        event,
+			eventName:    "pull_request",
+			label:        "staging",
+			lock:         "staging",
+			onConflict:   step.onConflict,
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", step.eventFilename, err)
+		}
+
+		if lm.failed() != step.failed {
+			t.Errorf("%s: failed: got %v, want %v", step.eventFilename, lm.failed(), step.failed)
+		}
+
+		summaryFile := filepath.Join(t.TempDir(), "summary.md")
+		var out bytes.Buffer
+		action := githubactions.New(githubactions.WithWriter(&out), githubactions.WithGetenv(func(key string) string {
+			if key == "GITHUB_STEP_SUMMARY" {
+				return summaryFile
+			}
+			return ""
+		}))
+		report(action, []*LabelMutex{lm})
+
+		if !strings.Contains(out.String(), step.annotation) {
+			t.Errorf("%s: annotations: got %q, want %q", step.eventFilename, out.String(), step.annotation)
+		}
+		summary, err := os.ReadFile(summaryFile)
+		if err != nil {
+			t.Fatalf("%s: %+v", step.eventFilename, err)
+		}
+		if !strings.Contains(string(summary), step.row) {
+			t.Errorf("%s: summary: got %q, want a row starting with %q", step.eventFilename, summary, step.row)
+		}
+	}
+}
+
+func TestSlots(t *testing.T) {
+	locker := &slotLocker{slots: []URILocker{&memoryLocker{}, &memoryLocker{}}}
+	steps := []struct {
+		eventFilename string
+		acquired      string
+		htmlURL       string
+	}{
+		{"testdata/1/pull_request.labeled.json", "true", "https://github.com/urcomputeringpal/label-mutex/pull/1"},
+		{"testdata/2/pull_request.labeled.json", "true", "https://github.com/urcomputeringpal/label-mutex/pull/2"},
+		{"testdata/1/pull_request.synchronize_with_labels.json", "true", "https://github.com/urcomputeringpal/label-mutex/pull/1"},
+		{"testdata/1/pull_request.closed.json", "false", ""},
+		{"testdata/2/pull_request.closed.json", "false", ""},
+	}
+	for _, step := range steps {
+		event, err := os.ReadFile(step.eventFilename)
+		if err != nil {
+			t.Fatalf("%s: %+v", step.eventFilename, err)
+		}
+		lm := &LabelMutex{
+			context:      context.Background(),
+			issuesClient: &happyPathLabelClient{},
+			uriLocker:    locker,
+			event:        event,
+			eventName:    "pull_request",
+			label:        "staging",
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", step.eventFilename, err)
+		}
+		output := lm.output()
+		if output["acquired"] != step.acquired {
+			t.Errorf("%s: outputs.acquired: got %v, want %v", step.eventFilename, output["acquired"], step.acquired)
+		}
+		if output["html_url"] != step.htmlURL {
+			t.Errorf("%s: outputs.html_url: got %v, want %v", step.eventFilename, output["html_url"], step.htmlURL)
+		}
+	}
+	if value, _ := locker.Read(); value != "" {
+		t.Errorf("expected every slot to be free, got %s", value)
+	}
+}
+
+// eventWithLabels returns the contents of a pull_request event with its labels replaced. For labeled and unlabeled
+// events, the first label is used as the event's label and is only kept on the PR if it was added.
+func eventWithLabels(t *testing.T, eventFilename string, labels ...string) []byte {
+	event, err := os.ReadFile(eventFilename)
+	if err != nil {
+		t.Fatalf("%s: %+v", eventFilename, err)
+	}
+	var pr github.PullRequestEvent
+	if err := json.Unmarshal(event, &pr); err != nil {
+		t.Fatalf("%s: %+v", eventFilename, err)
+	}
+	if pr.Label != nil {
+		pr.Label.Name = github.String(labels[0])
+		if pr.GetAction() == "unlabeled" {
+			labels = labels[1:]
+		}
+	}
+	pr.PullRequest.Labels = nil
+	for _, label := range labels {
+		pr.PullRequest.Labels = append(pr.PullRequest.Labels, &github.Label{Name: github.String(label)})
+	}
+	event, err = json.Marshal(pr)
+	if err != nil {
+		t.Fatalf("%s: %+v", eventFilename, err)
+	}
+	return event
+}
+
+func TestPatternLabelMutex(t *testing.T) {
+	lockers := make(map[string]*memoryLocker)
+	newLocker := func(name string) (URILocker, error) {
+		if lockers[name] == nil {
+			lockers[name] = &memoryLocker{}
+		}
+		return lockers[name], nil
+	}
+	pattern, err := newLabelPattern("env:(.*)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	steps := []struct {
+		event   []byte
+		holders map[string]string
+		locks   []string
+	}{
+		{eventWithLabels(t, "testdata/1/pull_request.labeled.json", "env:preview-1", "env:preview-2", "bug"), map[string]string{"preview-1": pr1, "preview-2": pr1}, []string{"preview-1", "preview-2"}},
+		{eventWithLabels(t, "testdata/2/pull_request.labeled.json", "env:preview-2", "env:preview-3"), map[string]string{"preview-1": pr1, "preview-2": pr1, "preview-3": pr2}, []string{"preview-2", "preview-3"}},
+		{eventWithLabels(t, "testdata/1/pull_request.unlabeled.json", "env:preview-1", "env:preview-2"), map[string]string{"preview-1": "", "preview-2": pr1, "preview-3": pr2}, []string{"preview-2", "preview-1"}},
+		{eventWithLabels(t, "testdata/1/pull_request.closed.json", "env:preview-2", "env:preview-2:locked"), map[string]string{"preview-1": "", "preview-2": "", "preview-3": pr2}, []string{"preview-2"}},
+	}
+	for i, step := range steps {
+		lm := &LabelMutex{
+			context:      context.Background(),
+			issuesClient: &happyPathLabelClient{},
+			newLocker:    newLocker,
+			pattern:      pattern,
+			event:        step.event,
+			eventName:    "pull_request",
+			label:        "env:(.*)",
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("step %d: %+v", i, err)
+		}
+		var locks []string
+		for _, match := range lm.mutexes() {
+			locks = append(locks, match.lock)
+		}
+		if !reflect.DeepEqual(locks, step.locks) {
+			t.Errorf("step %d: locks: got %v, want %v", i, locks, step.locks)
+		}
+		for name, holder := range step.holders {
+			if lockers[name].value != holder {
+				t.Errorf("step %d: %s: got holder %q, want %q", i, name, lockers[name].value, holder)
+			}
+		}
+	}
+}
+
+func TestGroupLocker(t *testing.T) {
+	db, api, cache := &memoryLocker{}, &memoryLocker{}, &memoryLocker{}
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	backends := newGroupLocker("staging-db+staging-api", []namedLocker{{"staging-db", db}, {"staging-api", api}})
+	apiAndCache := newGroupLocker("staging-cache+staging-api", []namedLocker{{"staging-cache", cache}, {"staging-api", api}})
+
+	// obtain both locks
+	success, holder, err := backends.Lock(pr1)
+	if !success || holder != pr1 || err != nil {
+		t.Fatalf("Lock: got %v, %v, %v; want true, %s, nil", success, holder, err, pr1)
+	}
+	// confirm both locks
+	success, holder, err = backends.Lock(pr1)
+	if success || holder != pr1 || err != nil {
+		t.Fatalf("Lock again: got %v, %v, %v; want false, %s, nil", success, holder, err, pr1)
+	}
+	// an overlapping group is refused without holding any of its locks
+	success, holder, err = apiAndCache.Lock(pr2)
+	if success || holder != pr1 || err != nil {
+		t.Fatalf("Lock overlapping group: got %v, %v, %v; want false, %s, nil", success, holder, err, pr1)
+	}
+	if cache.value != "" {
+		t.Errorf("expected staging-cache to be rolled back, held by %s", cache.value)
+	}
+	// closing the other PR doesn't release anything
+	holder, err = apiAndCache.Unlock(pr2)
+	if holder != pr1 || err == nil {
+		t.Errorf("Unlock overlapping group: got %v, %v; want %s and an error", holder, err, pr1)
+	}
+	// release both locks
+	holder, err = backends.Unlock(pr1)
+	if holder != "" || err != nil {
+		t.Fatalf("Unlock: got %v, %v; want \"\", nil", holder, err)
+	}
+	if db.value != "" || api.value != "" {
+		t.Errorf("expected both locks to be released, got %q and %q", db.value, api.value)
+	}
+	success, _, _ = apiAndCache.Lock(pr2)
+	if !success {
+		t.Errorf("expected the overlapping group to be obtained once the first group was released")
+	}
+}
+
+// failingLocker can't be locked
+type failingLocker struct {
+	memoryLocker
+}
+
+func (l *failingLocker) Lock(v string) (bool, string, error) {
+	return false, "", errors.New("backend unavailable")
+}
+
+func TestGroupLockerRollsBackOnError(t *testing.T) {
+	api := &memoryLocker{}
+	group := newGroupLocker("staging-db+staging-api", []namedLocker{{"staging-db", &failingLocker{}}, {"staging-api", api}})
+	success, _, err := group.Lock("https://github.com/urcomputeringpal/label-mutex/pull/1")
+	if success || err == nil {
+		t.Fatalf("Lock: got %v, %v; want false and an error", success, err)
+	}
+	if api.value != "" {
+		t.Errorf("expected staging-api to be rolled back, held by %s", api.value)
+	}
+}
+
+// memoryRecords is a recordStore that doesn't need a backend
+type memoryRecords map[string][]byte
+
+func (r memoryRecords) CreateRecord(key string, value []byte) (bool, error) {
+	if _, ok := r[key]; ok {
+		return false, nil
+	}
+	r[key] = value
+	return true, nil
+}
+
+func (r memoryRecords) PutRecord(key string, value []byte) error {
+	r[key] = value
+	return nil
+}
+
+func (r memoryRecords) GetRecord(key string) ([]byte, error) {
+	return r[key], nil
+}
+
+func (r memoryRecords) DeleteRecord(key string) error {
+	delete(r, key)
+	return nil
+}
+
+func (r memoryRecords) ListRecords(prefix string) (map[string][]byte, error) {
+	records := make(map[string][]byte)
+	for key, value := range r {
+		if strings.HasPrefix(key, prefix) {
+			records[key] = value
+		}
+	}
+	return records, nil
+}
+
+// keyListingRecords is a recordStore that lists keys without reading records, like GCS, counting the records read
+type keyListingRecords struct {
+	memoryRecords
+	reads int
+}
+
+func (r *keyListingRecords) GetRecord(key string) ([]byte, error) {
+	r.reads++
+	return r.memoryRecords.GetRecord(key)
+}
+
+func (r *keyListingRecords) ListRecordKeys(prefix string) ([]string, error) {
+	var keys []string
+	for key := range r.memoryRecords {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func TestSharedLabelMutex(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	dynamoLocker, err := NewDynamoURILocker("label-mutex", "staging", fmt.Sprintf("%v", uuid.New()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcsLocker, err := NewGCSLocker("label-mutex", fmt.Sprintf("%v", uuid.New()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockers := []*sharedLocker{
+		newSharedLocker("staging", &memoryLocker{}, memoryRecords{}, 0),
+		newSharedLocker(dynamoLocker.name, dynamoLocker, dynamoLocker, 0),
+		newSharedLocker(gcsLocker.name, gcsLocker, gcsLocker, 0),
+	}
+	for _, locker := range lockers {
+		steps := []struct {
+			event     []byte
+			eventName string
+			acquired  string
+			shared    string
+			htmlURL   string
+			readers   string
+		}{
+			{eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging:read"), "pull_request", "true", "true", pr1, fmt.Sprintf(`["%s"]`, pr1)},
+			{eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging:read"), "pull_request", "true", "true", pr2, fmt.Sprintf(`["%s","%s"]`, pr1, pr2)},
+			{eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging", "staging:read", "staging:read:locked"), "pull_request", "false", "false", pr1, "null"},
+			{eventWithLabels(t, "testdata/1/pull_request.unlabeled.json", "staging:read", "staging:read:locked"), "pull_request", "false", "false", "", fmt.Sprintf(`["%s"]`, pr2)},
+			{eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging", "staging:read", "staging:read:locked"), "pull_request", "true", "false", pr2, "null"},
+			{eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging:read"), "pull_request", "false", "false", pr2, "null"},
+			{eventWithLabels(t, "testdata/2/pull_request.closed.json", "staging", "staging:locked", "staging:read", "staging:read:locked"), "pull_request", "false", "false", "", "null"},
+			{eventWithLabels(t, "testdata/1/pull_request.closed.json", "staging:read"), "pull_request", "false", "false", "", "null"},
+		}
+		for i, step := range steps {
+			lm := &LabelMutex{
+				context:      context.Background(),
+				issuesClient: &happyPathLabelClient{},
+				uriLocker:    locker,
+				event:        step.event,
+				eventName:    step.eventName,
+				label:        "staging",
+				shared:       true,
+			}
+			if err := lm.process(); err != nil {
+				t.Fatalf("step %d (%s): %+v", i, locker.Provider(), err)
+			}
+			output := lm.output()
+			if output["acquired"] != step.acquired {
+				t.Errorf("step %d (%s): outputs.acquired: got %v, want %v", i, locker.Provider(), output["acquired"], step.acquired)
+			}
+			if output["shared"] != step.shared {
+				t.Errorf("step %d (%s): outputs.shared: got %v, want %v", i, locker.Provider(), output["shared"], step.shared)
+			}
+			if output["html_url"] != step.htmlURL {
+				t.Errorf("step %d (%s): outputs.html_url: got %v, want %v", i, locker.Provider(), output["html_url"], step.htmlURL)
+			}
+			if output["readers"] != step.readers {
+				t.Errorf("step %d (%s): outputs.readers: got %v, want %v", i, locker.Provider(), output["readers"], step.readers)
+			}
+		}
+		readers, err := locker.Readers()
+		if err != nil || len(readers) != 0 {
+			t.Errorf("%s: expected no readers, got %v, %v", locker.Provider(), readers, err)
+		}
+	}
+}
+
+func TestFencingTokens(t *testing.T) {
+	dynamoLocker, err := NewDynamoURILocker("label-mutex", "staging", fmt.Sprintf("%v", uuid.New()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcsLocker, err := NewGCSLocker("label-mutex", fmt.Sprintf("%v", uuid.New()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, locker := range []FencedLocker{dynamoLocker, gcsLocker} {
+		steps := []struct {
+			eventFilename string
+			eventName     string
+			holder        string
+		}{
+			{"testdata/1/pull_request.labeled.json", "pull_request", "https://github.com/urcomputeringpal/label-mutex/pull/1"},
+			{"testdata/2/pull_request.labeled.json", "pull_request", ""},
+			{"testdata/push.json", "push", "https://github.com/urcomputeringpal/label-mutex/pull/1"},
+			{"testdata/1/pull_request.closed.json", "pull_request", ""},
+			{"testdata/2/pull_request.labeled.json", "pull_request", "https://github.com/urcomputeringpal/label-mutex/pull/2"},
+			{"testdata/2/pull_request.labeled.json", "pull_request", "https://github.com/urcomputeringpal/label-mutex/pull/2"},
+		}
+		var tokens []int64
+		for i, step := range steps {
+			event, err := os.ReadFile(step.eventFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lm := &LabelMutex{
+				context:      context.Background(),
+				issuesClient: &happyPathLabelClient{},
+				uriLocker:    locker,
+				event:        event,
+				eventName:    step.eventName,
+				label:        "staging",
+			}
+			if err := lm.process(); err != nil {
+				t.Fatalf("step %d (%s): %+v", i, locker.Provider(), err)
+			}
+			token, err := strconv.ParseInt(lm.output()["fencing_token"], 10, 64)
+			if step.holder == "" {
+				if err == nil {
+					t.Errorf("step %d (%s): outputs.fencing_token: got %d, want none", i, locker.Provider(), token)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("step %d (%s): outputs.fencing_token: %+v", i, locker.Provider(), err)
+			}
+			tokens = append(tokens, token)
+		}
+		if len(tokens) != 4 || tokens[0] != tokens[1] || tokens[2] <= tokens[1] || tokens[3] != tokens[2] {
+			t.Errorf("%s: expected tokens to increase only when the lock changes hands, got %v", locker.Provider(), tokens)
+		}
+	}
+}
+
+func TestSteal(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	teams := &fakeTeamsClient{members: map[string][]string{"urcomputeringpal/admins": {"jnewland"}}}
+	for _, locker := range []URILocker{uuidLocker(), gcsUUIDLocker()} {
+		issues := newRecordingLabelClient()
+		steps := []struct {
+			event        []byte
+			eventName    string
+			stealAllowed []string
+			htmlURL      string
+			stolenFrom   string
+		}{
+			{eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), "pull_request", nil, pr1, ""},
+			{eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging:steal"), "pull_request", []string{"someone-else"}, pr1, ""},
+			{eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging:steal"), "pull_request", []string{"someone-else", "urcomputeringpal/admins"}, pr2, pr1},
+			{eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging", "staging:locked"), "pull_request", nil, pr2, ""},
+		}
+		for i, step := range steps {
+			lm := &LabelMutex{
+				context:      context.Background(),
+				issuesClient: issues,
+				teamsClient:  teams,
+				uriLocker:    locker,
+				event:        step.event,
+				eventName:    step.eventName,
+				label:        "staging",
+				lock:         "staging",
+				stealAllowed: step.stealAllowed,
+			}
+			if err := lm.process(); err != nil {
+				t.Fatalf("step %d (%s): %+v", i, locker.Provider(), err)
+			}
+			output := lm.output()
+			if output["html_url"] != step.htmlURL {
+				t.Errorf("step %d (%s): outputs.html_url: got %v, want %v", i, locker.Provider(), output["html_url"], step.htmlURL)
+			}
+			if output["stolen_from"] != step.stolenFrom {
+				t.Errorf("step %d (%s): outputs.stolen_from: got %v, want %v", i, locker.Provider(), output["stolen_from"], step.stolenFrom)
+			}
+		}
+
+		if want := []string{"staging", "staging:locked"}; !reflect.DeepEqual(issues.removed[1], want) {
+			t.Errorf("%s: labels removed from the previous holder: got %v, want %v", locker.Provider(), issues.removed[1], want)
+		}
+		if want := []string{"staging", "staging:locked"}; !reflect.DeepEqual(issues.added[2], want) {
+			t.Errorf("%s: labels added to the new holder: got %v, want %v", locker.Provider(), issues.added[2], want)
+		}
+		if len(issues.comments[1]) != 1 || !strings.Contains(issues.comments[1][0], "@jnewland stole") {
+			t.Errorf("%s: comments on the previous holder: got %v", locker.Provider(), issues.comments[1])
+		}
+		if len(issues.comments[2]) != 2 || !strings.Contains(issues.comments[2][0], "isn't allowed") || !strings.Contains(issues.comments[2][1], "@jnewland stole") {
+			t.Errorf("%s: comments on the new holder: got %v", locker.Provider(), issues.comments[2])
+		}
+
+		value, err := locker.(recordStore).GetRecord("staging.stolen")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var record stealRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			t.Fatalf("%s: %+v", locker.Provider(), err)
+		}
+		if record.By != "jnewland" || record.From != pr1 || record.To != pr2 {
+			t.Errorf("%s: steal record: got %+v", locker.Provider(), record)
+		}
+	}
+}
+
+// fakePermissionsClient reports the same permission level for everyone
+type fakePermissionsClient struct {
+	level *github.RepositoryPermissionLevel
+}
+
+func (c *fakePermissionsClient) GetPermissionLevel(ctx context.Context, owner string, repo string, user string) (*github.RepositoryPermissionLevel, *github.Response, error) {
+	return c.level, http200, nil
+}
+
+func TestAuthorization(t *testing.T) {
+	teams := &fakeTeamsClient{members: map[string][]string{"urcomputeringpal/admins": {"jnewland"}}}
+	triage := &github.RepositoryPermissionLevel{
+		Permission: github.String("read"),
+		User:       &github.User{Permissions: map[string]bool{"pull": true, "triage": true}},
+	}
+	write := &github.RepositoryPermissionLevel{Permission: github.String("write")}
+	tests := []struct {
+		name       string
+		allowed    []string
+		permission string
+		level      *github.RepositoryPermissionLevel
+		authorized bool
+	}{
+		{"unrestricted", nil, "", nil, true},
+		{"not in allowlist", []string{"someone-else"}, "", nil, false},
+		{"user in allowlist", []string{"@jnewland"}, "", nil, true},
+		{"team in allowlist", []string{"someone-else", "urcomputeringpal/admins"}, "", nil, true},
+		{"not in team", []string{"urcomputeringpal/sre"}, "", nil, false},
+		{"insufficient permission", nil, "write", triage, false},
+		{"sufficient permission", nil, "triage", triage, true},
+		{"classic permission level", nil, "write", write, true},
+		{"allowlist or permission", []string{"someone-else"}, "maintain", write, false},
+	}
+	for _, tt := range tests {
+		issues := newRecordingLabelClient()
+		lm := &LabelMutex{
+			context:           context.Background(),
+			issuesClient:      issues,
+			teamsClient:       teams,
+			permissionsClient: &fakePermissionsClient{level: tt.level},
+			uriLocker:         &memoryLocker{},
+			event:             eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"),
+			eventName:         "pull_request",
+			label:             "staging",
+			allowedRequesters: tt.allowed,
+			permission:        tt.permission,
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", tt.name, err)
+		}
+		if lm.acquired() != tt.authorized {
+			t.Errorf("%s: acquired: got %v, want %v", tt.name, lm.acquired(), tt.authorized)
+		}
+		if tt.authorized {
+			if len(issues.removed[1]) != 0 || len(issues.comments[1]) != 0 {
+				t.Errorf("%s: expected the request to be left alone, got %v removed and %v", tt.name, issues.removed[1], issues.comments[1])
+			}
+			continue
+		}
+		if !reflect.DeepEqual(issues.removed[1], []string{"staging"}) {
+			t.Errorf("%s: labels removed: got %v, want [staging]", tt.name, issues.removed[1])
+		}
+		if len(issues.comments[1]) != 1 || !strings.Contains(issues.comments[1][0], "@jnewland isn't allowed to request the `staging` lock") {
+			t.Errorf("%s: comments: got %v", tt.name, issues.comments[1])
+		}
+	}
+}
+
+func TestRefusedHolderReleased(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	issues := newRecordingLabelClient()
+	locker := newSharedLocker("staging", &memoryLocker{}, memoryRecords{}, 0)
+	steps := []struct {
+		name     string
+		event    []byte
+		allowed  []string
+		holder   string
+		readers  []string
+		released bool
+		removed  []string
+	}{
+		{"locked", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), nil, pr1, nil, false, nil},
+		{"refused while holding the lock", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging", "staging:locked"), []string{"someone-else"}, "", nil, true, []string{"staging", "staging:locked"}},
+		{"shared", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging:read"), nil, "", []string{pr1}, false, []string{"staging", "staging:locked"}},
+		{"refused while sharing the lock", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging:read", "staging:read:locked"), []string{"someone-else"}, "", nil, false, []string{"staging", "staging:locked", "staging:read", "staging:read:locked"}},
+	}
+	for _, step := range steps {
+		lm := &LabelMutex{
+			context:           context.Background(),
+			issuesClient:      issues,
+			teamsClient:       &fakeTeamsClient{},
+			uriLocker:         locker,
+			event:             step.event,
+			eventName:         "pull_request",
+			label:             "staging",
+			lock:              "staging",
+			shared:            true,
+			allowedRequesters: step.allowed,
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", step.name, err)
+		}
+		holder, err := locker.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers, err := locker.Readers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if holder != step.holder || !reflect.DeepEqual(readers, step.readers) {
+			t.Errorf("%s: holder: got %q with readers %v, want %q with %v", step.name, holder, readers, step.holder, step.readers)
+		}
+		if lm.released != step.released {
+			t.Errorf("%s: released: got %v, want %v", step.name, lm.released, step.released)
+		}
+		if !reflect.DeepEqual(issues.removed[1], step.removed) {
+			t.Errorf("%s: labels removed: got %v, want %v", step.name, issues.removed[1], step.removed)
+		}
+	}
+}
+
+// fakePullRequestsClient serves a fixed set of PRs
+type fakePullRequestsClient struct {
+	prs []*github.PullRequest
+}
+
+func (c *fakePullRequestsClient) List(ctx context.Context, owner string, repo string, opts *github.PullRequestListOptions) ([]*github.PullRequest, *github.Response, error) {
+	var prs []*github.PullRequest
+	for _, pr := range c.prs {
+		if pr.GetState() == opts.State {
+			prs = append(prs, pr)
+		}
+	}
+	return prs, http200, nil
+}
+
+func (c *fakePullRequestsClient) Get(ctx context.Context, owner string, repo string, number int) (*github.PullRequest, *github.Response, error) {
+	for _, pr := range c.prs {
+		if pr.GetNumber() == number {
+			return pr, http200, nil
+		}
+	}
+	return nil, http404, errors.New("not found")
+}
+
+func pullRequest(number int, state string, labels ...string) *github.PullRequest {
+	pr := &github.PullRequest{
+		Number:  github.Int(number),
+		State:   github.String(state),
+		HTMLURL: github.String(fmt.Sprintf("https://github.com/urcomputeringpal/label-mutex/pull/%d", number)),
+		Base: &github.PullRequestBranch{
+			Repo: &github.Repository{
+				Name:  github.String("label-mutex"),
+				Owner: &github.User{Login: github.String("urcomputeringpal")},
+			},
+		},
+	}
+	for _, label := range labels {
+		pr.Labels = append(pr.Labels, &github.Label{Name: github.String(label)})
+	}
+	return pr
+}
+
+func TestReconcile(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	event := []byte(`{"schedule": "*/15 * * * *", "repository": {"name": "label-mutex", "owner": {"login": "urcomputeringpal"}}}`)
+	tests := []struct {
+		name       string
+		eventName  string
+		holder     string
+		dispatched bool
+		prs        []*github.PullRequest
+		htmlURL    string
+		added      map[int][]string
+		removed    map[int][]string
+		repairs    int
+	}{
+		{
+			name:      "in sync",
+			eventName: "schedule",
+			holder:    pr1,
+			prs:       []*github.PullRequest{pullRequest(1, "open", "staging", "staging:locked"), pullRequest(2, "open", "staging")},
+			htmlURL:   pr1,
+			added:     map[int][]string{},
+			removed:   map[int][]string{},
+		},
+		{
+			name:      "holder missing confirmation and stale confirmation",
+			eventName: "workflow_dispatch",
+			holder:    pr1,
+			prs:       []*github.PullRequest{pullRequest(1, "open", "staging"), pullRequest(2, "open", "staging", "staging:locked")},
+			htmlURL:   pr1,
+			added:     map[int][]string{1: {"staging:locked"}},
+			removed:   map[int][]string{2: {"staging:locked"}},
+			repairs:   2,
+		},
+		{
+			name:      "holder closed",
+			eventName: "schedule",
+			holder:    pr1,
+			prs:       []*github.PullRequest{pullRequest(1, "closed", "staging", "staging:locked")},
+			added:     map[int][]string{},
+			removed:   map[int][]string{1: {"staging", "staging:locked"}},
+			repairs:   1,
+		},
+		{
+			name:      "holder no longer requesting the lock",
+			eventName: "schedule",
+			holder:    pr1,
+			prs:       []*github.PullRequest{pullRequest(1, "open", "staging:locked")},
+			added:     map[int][]string{},
+			removed:   map[int][]string{1: {"staging:locked"}},
+			repairs:   1,
+		},
+		{
+			name:       "holder obtained the lock without its label",
+			eventName:  "schedule",
+			holder:     pr1,
+			dispatched: true,
+			prs:        []*github.PullRequest{pullRequest(1, "open")},
+			htmlURL:    pr1,
+			added:      map[int][]string{},
+			removed:    map[int][]string{},
+		},
+		{
+			name:      "not a scheduled event",
+			eventName: "push",
+			holder:    pr1,
+			prs:       []*github.PullRequest{pullRequest(1, "closed", "staging", "staging:locked")},
+			added:     map[int][]string{},
+			removed:   map[int][]string{},
+		},
+	}
+	for _, tt := range tests {
+		issues := newRecordingLabelClient()
+		locker := &recordingMemoryLocker{&memoryLocker{value: tt.holder}, memoryRecords{}}
+		lm := &LabelMutex{
+			context:            context.Background(),
+			issuesClient:       issues,
+			pullRequestsClient: &fakePullRequestsClient{prs: tt.prs},
+			uriLocker:          locker,
+			event:              event,
+			eventName:          tt.eventName,
+			label:              "staging",
+			lock:               "staging",
+			mode:               modeReconcile,
+		}
+		record := holderRecord{Holder: tt.holder, Priority: priorityNormal, Since: time.Now()}
+		if !tt.dispatched {
+			record.Label = "staging"
+		}
+		value, err := json.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := locker.PutRecord(lm.holderKey(), value); err != nil {
+			t.Fatal(err)
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", tt.name, err)
+		}
+		if tt.eventName != "push" && lm.htmlURL != tt.htmlURL {
+			t.Errorf("%s: html_url: got %v, want %v", tt.name, lm.htmlURL, tt.htmlURL)
+		}
+		if !reflect.DeepEqual(issues.added, tt.added) {
+			t.Errorf("%s: labels added: got %v, want %v", tt.name, issues.added, tt.added)
+		}
+		if !reflect.DeepEqual(issues.removed, tt.removed) {
+			t.Errorf("%s: labels removed: got %v, want %v", tt.name, issues.removed, tt.removed)
+		}
+		var repairs []string
+		if err := json.Unmarshal([]byte(lm.output()["repairs"]), &repairs); err != nil || len(repairs) != tt.repairs {
+			t.Errorf("%s: repairs: got %v, want %d", tt.name, lm.output()["repairs"], tt.repairs)
+		}
+	}
+}
+
+func TestValidateHolder(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	event, err := os.ReadFile("testdata/push.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		holder   string
+		label    string
+		prs      []*github.PullRequest
+		htmlURL  string
+		released bool
+		removed  map[int][]string
+	}{
+		{"open and labeled", pr1, "staging", []*github.PullRequest{pullRequest(1, "open", "staging", "staging:locked")}, pr1, false, map[int][]string{}},
+		{"closed", pr1, "staging", []*github.PullRequest{pullRequest(1, "closed", "staging", "staging:locked")}, "", true, map[int][]string{1: {"staging", "staging:locked"}}},
+		{"no longer labeled", pr1, "staging", []*github.PullRequest{pullRequest(1, "open", "staging:locked")}, "", true, map[int][]string{1: {"staging:locked"}}},
+		{"not a PR", "https://example.com/deploys/1", "", nil, "https://example.com/deploys/1", false, map[int][]string{}},
+		{"dispatched", pr1, "", []*github.PullRequest{pullRequest(1, "open")}, pr1, false, map[int][]string{}},
+		{"obtained through a lock group", pr1, "staging-backends", []*github.PullRequest{pullRequest(1, "open", "staging-backends")}, pr1, false, map[int][]string{}},
+		{"PR can't be read", pr1, "staging", nil, pr1, false, map[int][]string{}},
+	}
+	for _, tt := range tests {
+		issues := newRecordingLabelClient()
+		locker := &recordingMemoryLocker{&memoryLocker{value: tt.holder}, memoryRecords{}}
+		value, err := json.Marshal(holderRecord{Holder: tt.holder, Priority: priorityNormal, Label: tt.label})
+		if err != nil {
+			t.Fatal(err)
+		}
+		locker.PutRecord("staging.holder", value)
+		lm := &LabelMutex{
+			context:            context.Background(),
+			issuesClient:       issues,
+			pullRequestsClient: &fakePullRequestsClient{prs: tt.prs},
+			uriLocker:          locker,
+			event:              event,
+			eventName:          "push",
+			label:              "staging",
+			lock:               "staging",
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", tt.name, err)
+		}
+		if lm.htmlURL != tt.htmlURL || locker.value != tt.htmlURL {
+			t.Errorf("%s: holder: got %v (stored %v), want %v", tt.name, lm.htmlURL, locker.value, tt.htmlURL)
+		}
+		if lm.unlocked != (tt.htmlURL == "") {
+			t.Errorf("%s: unlocked: got %v, want %v", tt.name, lm.unlocked, tt.htmlURL == "")
+		}
+		if lm.released != tt.released {
+			t.Errorf("%s: released: got %v, want %v", tt.name, lm.released, tt.released)
+		}
+		if !reflect.DeepEqual(issues.removed, tt.removed) {
+			t.Errorf("%s: labels removed: got %v, want %v", tt.name, issues.removed, tt.removed)
+		}
+	}
+}
+
+// recordingMemoryLocker is a memoryLocker that stores records alongside the lock
+type recordingMemoryLocker struct {
+	*memoryLocker
+	memoryRecords
+}
+
+func TestWaiters(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	for _, notify := range []string{notifyComment, notifyRelabel, notifyNone} {
+		issues := newRecordingLabelClient()
+		locker := &recordingMemoryLocker{&memoryLocker{}, memoryRecords{}}
+		steps := []struct {
+			event   []byte
+			htmlURL string
+			queue   []string
+		}{
+			{eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), pr1, nil},
+			// the requester isn't listed in its own queue
+			{eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging"), pr1, nil},
+			{eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging"), pr1, nil},
+			{eventWithLabels(t, "testdata/1/pull_request.closed.json", "staging", "staging:locked"), "", []string{pr2}},
+			{eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging"), pr2, nil},
+		}
+		for i, step := range steps {
+			lm := &LabelMutex{
+				context:      context.Background(),
+				issuesClient: issues,
+				uriLocker:    locker,
+				event:        step.event,
+				eventName:    "pull_request",
+				label:        "staging",
+				lock:         "staging",
+				notify:       notify,
+			}
+			if err := lm.process(); err != nil {
+				t.Fatalf("%s step %d: %+v", notify, i, err)
+			}
+			if lm.htmlURL != step.htmlURL {
+				t.Errorf("%s step %d: html_url: got %v, want %v", notify, i, lm.htmlURL, step.htmlURL)
+			}
+			if notify == notifyNone {
+				continue
+			}
+			if queue := lm.queue(); !reflect.DeepEqual(queue, step.queue) {
+				t.Errorf("%s step %d: queue: got %v, want %v", notify, i, queue, step.queue)
+			}
+		}
+
+		switch notify {
+		case notifyNone:
+			waiters, _ := locker.ListRecords("staging.waiters.")
+			if len(issues.comments[2]) != 0 || len(waiters) != 0 {
+				t.Errorf("%s: expected no waiters to be tracked, got %v and %v", notify, issues.comments[2], waiters)
+			}
+		case notifyComment:
+			if len(issues.comments[2]) != 1 || !strings.Contains(issues.comments[2][0], "@jnewland the `staging` lock was released by "+pr1) {
+				t.Errorf("%s: comments on the waiting PR: got %v", notify, issues.comments[2])
+			}
+			if len(issues.added[2]) != 1 {
+				t.Errorf("%s: expected only the confirmation label to be added, got %v", notify, issues.added[2])
+			}
+		case notifyRelabel:
+			if len(issues.comments[2]) != 1 || !strings.Contains(issues.comments[2][0], "`staging:wake` was added") {
+				t.Errorf("%s: comments on the waiting PR: got %v", notify, issues.comments[2])
+			}
+			if len(issues.removed[2]) != 0 || !reflect.DeepEqual(issues.added[2], []string{"staging:wake", "staging:locked"}) {
+				t.Errorf("%s: expected the waiting PR to be woken, got %v removed and %v added", notify, issues.removed[2], issues.added[2])
+			}
+		}
+	}
+}
+
+func TestWakeWaiter(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	issues := newRecordingLabelClient()
+	locker := &recordingMemoryLocker{&memoryLocker{}, memoryRecords{}}
+	steps := []struct {
+		name    string
+		event   []byte
+		holder  string
+		added   []string
+		removed []string
+	}{
+		{"first request", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), pr1, nil, nil},
+		{"waiting", eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging"), pr1, nil, nil},
+		{"released", eventWithLabels(t, "testdata/1/pull_request.closed.json", "staging", "staging:locked"), "", []string{"staging:wake"}, nil},
+		{"woken", eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging:wake", "staging"), pr2, []string{"staging:wake", "staging:locked"}, []string{"staging:wake"}},
+		{"wake label removed", eventWithLabels(t, "testdata/2/pull_request.unlabeled.json", "staging:wake", "staging", "staging:locked"), pr2, []string{"staging:wake", "staging:locked"}, []string{"staging:wake"}},
+	}
+	for _, step := range steps {
+		lm := &LabelMutex{
+			context:      context.Background(),
+			issuesClient: issues,
+			uriLocker:    locker,
+			event:        step.event,
+			eventName:    "pull_request",
+			label:        "staging",
+			lock:         "staging",
+			notify:       notifyRelabel,
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", step.name, err)
+		}
+		if locker.value != step.holder {
+			t.Errorf("%s: holder: got %v, want %v", step.name, locker.value, step.holder)
+		}
+		if !reflect.DeepEqual(issues.added[2], step.added) || !reflect.DeepEqual(issues.removed[2], step.removed) {
+			t.Errorf("%s: labels on the waiting PR: got %v added and %v removed, want %v and %v", step.name, issues.added[2], issues.removed[2], step.added, step.removed)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	dynamoLocker, err := NewDynamoURILocker("label-mutex", "staging", fmt.Sprintf("%v", uuid.New()), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcsLocker, err := NewGCSLocker("label-mutex", fmt.Sprintf("%v", uuid.New()), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockers := map[string]URILocker{dynamoLocker.name: dynamoLocker, gcsLocker.name: gcsLocker}
+	for name, locker := range lockers {
+		steps := []struct {
+			event     []byte
+			wait      time.Duration
+			confirmed bool
+		}{
+			{event: eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging")},
+			{event: eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging")},
+			{event: eventWithLabels(t, "testdata/1/pull_request.closed.json", "staging", "staging:locked")},
+			{event: eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging")},
+			{event: eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), wait: 4 * time.Second},
+			{event: eventWithLabels(t, "testdata/1/pull_request.synchronize_with_labels.json", "staging", "staging:locked"), confirmed: true},
+		}
+		for i, step := range steps {
+			time.Sleep(step.wait)
+			lm := &LabelMutex{
+				context:      context.Background(),
+				issuesClient: &happyPathLabelClient{},
+				uriLocker:    locker,
+				event:        step.event,
+				eventName:    "pull_request",
+				label:        "staging",
+				lock:         name,
+				notify:       notifyNone,
+			}
+			if err := lm.process(); err != nil {
+				t.Fatalf("%s step %d: %+v", locker.Provider(), i, err)
+			}
+			if step.confirmed && (!lm.acquired() || !lm.acquiredAt.IsZero()) {
+				t.Errorf("%s step %d: expected the lock to be confirmed without being obtained again, got acquired %v at %v", locker.Provider(), i, lm.acquired(), lm.acquiredAt)
+			}
+		}
+
+		want := []struct {
+			event string
+			pr    string
+		}{
+			{historyAcquire, pr1},
+			{historyExpire, pr2},
+			{historyAcquire, pr2},
+			{historyRelease, pr1},
+			{historyRefuse, pr2},
+			{historyAcquire, pr1},
+		}
+		for _, limit := range []int{0, 2} {
+			lm := &LabelMutex{
+				context:      context.Background(),
+				uriLocker:    locker,
+				event:        []byte(`{}`),
+				eventName:    "workflow_dispatch",
+				label:        "staging",
+				lock:         name,
+				mode:         modeHistory,
+				historyLimit: limit,
+			}
+			if err := lm.process(); err != nil {
+				t.Fatalf("%s: %+v", locker.Provider(), err)
+			}
+			var history []historyEntry
+			if err := json.Unmarshal([]byte(lm.output()["history"]), &history); err != nil {
+				t.Fatalf("%s: %+v", locker.Provider(), err)
+			}
+			expected := want
+			if limit > 0 {
+				expected = want[:limit]
+			}
+			if len(history) != len(expected) {
+				t.Fatalf("%s: history: got %+v, want %+v", locker.Provider(), history, expected)
+			}
+			for i, entry := range history {
+				if entry.Event != expected[i].event || entry.PR != expected[i].pr || entry.Lock != name || entry.Actor != "jnewland" {
+					t.Errorf("%s: history entry %d: got %+v, want %+v", locker.Provider(), i, entry, expected[i])
+				}
+			}
+		}
+	}
+}
+
+func TestHistoryReadsOnlyTheLimit(t *testing.T) {
+	records := &keyListingRecords{memoryRecords: memoryRecords{}}
+	locker := struct {
+		*memoryLocker
+		*keyListingRecords
+	}{&memoryLocker{}, records}
+	lm := &LabelMutex{uriLocker: locker, lock: "staging", historyLimit: 2}
+	for i := 1; i <= 5; i++ {
+		lm.appendHistory(historyAcquire, fmt.Sprintf("https://github.com/urcomputeringpal/label-mutex/pull/%d", i))
+	}
+	records.reads = 0
+	if err := lm.readHistory(); err != nil {
+		t.Fatal(err)
+	}
+	if records.reads != 2 {
+		t.Errorf("got %d records read, want 2", records.reads)
+	}
+	if len(lm.history) != 2 || !strings.HasSuffix(lm.history[0].PR, "/5") || !strings.HasSuffix(lm.history[1].PR, "/4") {
+		t.Errorf("history: got %+v, want the two newest entries", lm.history)
+	}
+}
+
+func TestMergeGroup(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	checksRequested, err := os.ReadFile("testdata/merge_group.checks_requested.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	destroyed, err := os.ReadFile("testdata/merge_group.destroyed.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		event    []byte
+		holder   string
+		htmlURL  string
+		acquired bool
+		released bool
+		added    map[int][]string
+		removed  map[int][]string
+	}{
+		{"free", checksRequested, "", pr1, true, false, map[int][]string{1: {"staging", "staging:locked"}}, map[int][]string{}},
+		{"already held", checksRequested, pr1, pr1, true, false, map[int][]string{}, map[int][]string{}},
+		{"held by another PR", checksRequested, pr2, pr2, false, false, map[int][]string{}, map[int][]string{}},
+		{"destroyed", destroyed, pr1, "", false, true, map[int][]string{}, map[int][]string{1: {"staging", "staging:locked"}}},
+		{"destroyed while held by another PR", destroyed, pr2, pr2, false, false, map[int][]string{}, map[int][]string{}},
+	}
+	for _, tt := range tests {
+		issues := newRecordingLabelClient()
+		locker := &memoryLocker{value: tt.holder}
+		lm := &LabelMutex{
+			context:            context.Background(),
+			issuesClient:       issues,
+			pullRequestsClient: &fakePullRequestsClient{prs: []*github.PullRequest{pullRequest(1, "open")}},
+			uriLocker:          locker,
+			event:              tt.event,
+			eventName:          "merge_group",
+			label:              "staging",
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", tt.name, err)
+		}
+		if lm.htmlURL != tt.htmlURL || locker.value != tt.htmlURL {
+			t.Errorf("%s: holder: got %v (stored %v), want %v", tt.name, lm.htmlURL, locker.value, tt.htmlURL)
+		}
+		if lm.acquired() != tt.acquired {
+			t.Errorf("%s: acquired: got %v, want %v", tt.name, lm.acquired(), tt.acquired)
+		}
+		if lm.released != tt.released {
+			t.Errorf("%s: released: got %v, want %v", tt.name, lm.released, tt.released)
+		}
+		if !reflect.DeepEqual(issues.added, tt.added) {
+			t.Errorf("%s: labels added: got %v, want %v", tt.name, issues.added, tt.added)
+		}
+		if !reflect.DeepEqual(issues.removed, tt.removed) {
+			t.Errorf("%s: labels removed: got %v, want %v", tt.name, issues.removed, tt.removed)
+		}
+	}
+}
+
+func TestPullRequestTarget(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	var fork github.PullRequestEvent
+	if err := json.Unmarshal(eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), &fork); err != nil {
+		t.Fatal(err)
+	}
+	fork.PullRequest.Head.Repo = &github.Repository{ID: github.Int64(1), FullName: github.String("contributor/label-mutex")}
+	forkEvent, err := json.Marshal(fork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	review, err := json.Marshal(github.PullRequestReviewEvent{
+		Action:      github.String("submitted"),
+		PullRequest: fork.PullRequest,
+		Review:      &github.PullRequestReview{State: github.String("approved")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		eventName   string
+		event       []byte
+		fork        string
+		deployments int
+	}{
+		{"same repository", "pull_request_target", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), "", 1},
+		// code from forks is never deployed
+		{"fork", "pull_request_target", forkEvent, "true", 0},
+		{"review of fork", "pull_request_review", review, "true", 0},
+	}
+	for _, tt := range tests {
+		deployments := &fakeDeploymentsClient{}
+		lm := &LabelMutex{
+			context:           context.Background(),
+			issuesClient:      &happyPathLabelClient{},
+			deploymentsClient: deployments,
+			uriLocker:         &memoryLocker{},
+			event:             tt.event,
+			eventName:         tt.eventName,
+			label:             "staging",
+			environment:       "staging",
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", tt.name, err)
+		}
+		if !lm.acquired() || lm.htmlURL != pr1 {
+			t.Errorf("%s: got holder %v (acquired %v), want %v", tt.name, lm.htmlURL, lm.acquired(), pr1)
+		}
+		if got := lm.output()["fork"]; got != tt.fork {
+			t.Errorf("%s: outputs.fork: got %v, want %v", tt.name, got, tt.fork)
+		}
+		if len(deployments.deployments) != tt.deployments {
+			t.Errorf("%s: got %d deployments, want %d", tt.name, len(deployments.deployments), tt.deployments)
+		}
+	}
+}
+
+func TestHolders(t *testing.T) {
+	issue := "https://github.com/urcomputeringpal/label-mutex/issues/3"
+	run := "https://github.com/urcomputeringpal/label-mutex/actions/runs/42"
+	commit := "https://github.com/urcomputeringpal/label-mutex/commit/f9748b56ccc9c49cab08e40c014a5e7cec1feeb4"
+	repo := &github.Repository{
+		ID:    github.Int64(306053368),
+		Name:  github.String("label-mutex"),
+		Owner: &github.User{Login: github.String("urcomputeringpal")},
+	}
+	sender := &github.User{Login: github.String("jnewland")}
+	issuesEvent := func(action string, state string, labels ...string) []byte {
+		event := github.IssuesEvent{
+			Action: github.String(action),
+			Issue:  &github.Issue{Number: github.Int(3), State: github.String(state), HTMLURL: github.String(issue)},
+			Label:  &github.Label{Name: github.String("staging")},
+			Repo:   repo,
+			Sender: sender,
+		}
+		for _, label := range labels {
+			event.Issue.Labels = append(event.Issue.Labels, &github.Label{Name: github.String(label)})
+		}
+		b, err := json.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	workflowRunEvent := func(action string, status string) []byte {
+		b, err := json.Marshal(github.WorkflowRunEvent{
+			Action: github.String(action),
+			WorkflowRun: &github.WorkflowRun{
+				HTMLURL:        github.String(run),
+				Status:         github.String(status),
+				HeadSHA:        github.String("f9748b56ccc9c49cab08e40c014a5e7cec1feeb4"),
+				Repository:     repo,
+				HeadRepository: repo,
+			},
+			Repo:   repo,
+			Sender: sender,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	dispatchEvent, err := json.Marshal(github.WorkflowDispatchEvent{Repo: repo, Sender: sender})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		eventName string
+		event     []byte
+		holderURL string
+		unlock    bool
+		holder    string
+		added     map[int][]string
+		removed   map[int][]string
+	}{
+		{"issue labeled", "issues", issuesEvent("labeled", "open", "staging"), "", false, issue, map[int][]string{3: {"staging:locked"}}, map[int][]string{}},
+		{"issue closed", "issues", issuesEvent("closed", "closed", "staging", "staging:locked"), "", false, "", map[int][]string{}, map[int][]string{3: {"staging", "staging:locked"}}},
+		{"workflow run requested", "workflow_run", workflowRunEvent("requested", "queued"), "", false, run, map[int][]string{}, map[int][]string{}},
+		{"workflow run completed", "workflow_run", workflowRunEvent("completed", "completed"), "", false, "", map[int][]string{}, map[int][]string{}},
+		{"dispatched holder", "workflow_dispatch", dispatchEvent, commit, false, commit, map[int][]string{}, map[int][]string{}},
+		{"dispatched unlock", "workflow_dispatch", dispatchEvent, commit, true, "", map[int][]string{}, map[int][]string{}},
+	}
+	locker := &memoryLocker{}
+	for _, tt := range tests {
+		issues := newRecordingLabelClient()
+		lm := &LabelMutex{
+			context:      context.Background(),
+			issuesClient: issues,
+			uriLocker:    locker,
+			event:        tt.event,
+			eventName:    tt.eventName,
+			label:        "staging",
+			holderURL:    tt.holderURL,
+			unlock:       tt.unlock,
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", tt.name, err)
+		}
+		if lm.htmlURL != tt.holder || locker.value != tt.holder {
+			t.Errorf("%s: holder: got %v (stored %v), want %v", tt.name, lm.htmlURL, locker.value, tt.holder)
+		}
+		if lm.acquired() != (tt.holder != "") {
+			t.Errorf("%s: acquired: got %v, want %v", tt.name, lm.acquired(), tt.holder != "")
+		}
+		if lm.released != (tt.holder == "") {
+			t.Errorf("%s: released: got %v, want %v", tt.name, lm.released, tt.holder == "")
+		}
+		if !reflect.DeepEqual(issues.added, tt.added) {
+			t.Errorf("%s: labels added: got %v, want %v", tt.name, issues.added, tt.added)
+		}
+		if !reflect.DeepEqual(issues.removed, tt.removed) {
+			t.Errorf("%s: labels removed: got %v, want %v", tt.name, issues.removed, tt.removed)
+		}
+	}
+
+	refusals := []struct {
+		name         string
+		eventName    string
+		event        []byte
+		unlock       bool
+		allowed      []string
+		stored       string
+		unauthorized string
+	}{
+		{"dispatched holder", "workflow_dispatch", dispatchEvent, false, []string{"jnewland"}, commit, ""},
+		{"unauthorized unlock", "workflow_dispatch", dispatchEvent, true, []string{"someone-else"}, commit, "jnewland"},
+		{"unauthorized workflow run", "workflow_run", workflowRunEvent("requested", "queued"), false, []string{"someone-else"}, commit, "jnewland"},
+		{"unauthorized workflow run completed", "workflow_run", workflowRunEvent("completed", "completed"), false, []string{"someone-else"}, commit, "jnewland"},
+	}
+	for _, tt := range refusals {
+		lm := &LabelMutex{
+			context:           context.Background(),
+			issuesClient:      newRecordingLabelClient(),
+			uriLocker:         locker,
+			event:             tt.event,
+			eventName:         tt.eventName,
+			label:             "staging",
+			holderURL:         commit,
+			unlock:            tt.unlock,
+			allowedRequesters: tt.allowed,
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", tt.name, err)
+		}
+		if locker.value != tt.stored {
+			t.Errorf("%s: stored: got %v, want %v", tt.name, locker.value, tt.stored)
+		}
+		if lm.unauthorized != tt.unauthorized {
+			t.Errorf("%s: unauthorized: got %v, want %v", tt.name, lm.unauthorized, tt.unauthorized)
+		}
+	}
+}
+
+func TestReservations(t *testing.T) {
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	now := time.Now().UTC().Truncate(time.Second)
+	calendarFile := filepath.Join(t.TempDir(), "calendar.yml")
+	calendarYAML := fmt.Sprintf(`reservations:
+  - lock: staging
+    start: %s
+    end: %s
+    reason: Release weekend
+  - lock: qa
+    start: %s
+    end: %s
+`, now.Add(-time.Hour).Format(time.RFC3339), now.Add(-time.Minute).Format(time.RFC3339), now.Add(-time.Hour).Format(time.RFC3339), now.Add(time.Hour).Format(time.RFC3339))
+	if err := os.WriteFile(calendarFile, []byte(calendarYAML), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	calendar, err := loadCalendar(calendarFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calendar) != 2 || calendar[0].Reason != "Release weekend" || !calendar[0].End.Equal(now.Add(-time.Minute)) {
+		t.Fatalf("calendar: got %+v", calendar)
+	}
+
+	issues := newRecordingLabelClient()
+	locker := &recordingMemoryLocker{&memoryLocker{}, memoryRecords{}}
+	freeze := reservation{Start: now.Add(-time.Minute), End: now.Add(time.Hour), Reason: "Load test"}
+	loadTest := reservation{Start: now.Add(-time.Minute), End: now.Add(time.Hour), Holder: pr2, Reason: "Load test"}
+	steps := []struct {
+		name        string
+		mode        string
+		pending     reservation
+		event       []byte
+		htmlURL     string
+		reserved    bool
+		reservation int
+	}{
+		{"freeze", modeReserve, freeze, []byte(`{}`), "", false, 1},
+		{"frozen", modeLock, reservation{}, eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), "", true, 1},
+		{"thaw", modeUnreserve, freeze, []byte(`{}`), "", false, 0},
+		{"reserve", modeReserve, loadTest, []byte(`{}`), "", false, 1},
+		{"reserved for another holder", modeLock, reservation{}, eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), "", true, 1},
+		{"reserved for the holder", modeLock, reservation{}, eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging"), pr2, false, 1},
+	}
+	for _, step := range steps {
+		lm := &LabelMutex{
+			context:            context.Background(),
+			issuesClient:       issues,
+			uriLocker:          locker,
+			event:              step.event,
+			eventName:          "pull_request",
+			label:              "staging",
+			lock:               "staging",
+			mode:               step.mode,
+			calendar:           calendar,
+			pendingReservation: step.pending,
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", step.name, err)
+		}
+		if lm.htmlURL != step.htmlURL || locker.value != step.htmlURL {
+			t.Errorf("%s: holder: got %v (stored %v), want %v", step.name, lm.htmlURL, locker.value, step.htmlURL)
+		}
+		if (lm.reservation != nil) != step.reserved {
+			t.Errorf("%s: reserved: got %+v, want %v", step.name, lm.reservation, step.reserved)
+		}
+		if step.reserved && lm.output()["reservation"] == "" {
+			t.Errorf("%s: missing reservation output", step.name)
+		}
+		if step.mode != modeLock {
+			var reservations []reservation
+			if err := json.Unmarshal([]byte(lm.output()["reservations"]), &reservations); err != nil {
+				t.Fatalf("%s: %+v", step.name, err)
+			}
+			// the calendar's reservation of staging has ended but is still listed
+			if len(reservations) != step.reservation+1 {
+				t.Errorf("%s: reservations: got %+v, want %d", step.name, reservations, step.reservation+1)
+			}
+		}
+	}
+	if len(issues.comments[1]) != 2 || len(issues.comments[2]) != 0 {
+		t.Errorf("comments: got %v", issues.comments)
+	}
+}
+
+func TestPreemption(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	teams := &fakeTeamsClient{members: map[string][]string{"urcomputeringpal/hotfixers": {"jnewland"}}}
+	dynamoLocker, err := NewDynamoURILocker("label-mutex", "staging", fmt.Sprintf("%v", uuid.New()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcsLocker, err := NewGCSLocker("label-mutex", fmt.Sprintf("%v", uuid.New()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockers := map[string]URILocker{dynamoLocker.name: dynamoLocker, gcsLocker.name: gcsLocker}
+	for name, locker := range lockers {
+		issues := newRecordingLabelClient()
+		steps := []struct {
+			name          string
+			event         []byte
+			priorities    map[string]string
+			gracePeriod   time.Duration
+			expire        bool
+			htmlURL       string
+			preemptedFrom string
+			preemptAt     bool
+		}{
+			{"first request", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), nil, 0, false, pr1, "", false},
+			{"equal priority", eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging"), nil, 0, false, pr1, "", false},
+			{"higher priority label", eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging:priority-high", "staging"), map[string]string{"urcomputeringpal/sre": priorityHigh}, 0, false, pr2, pr1, false},
+			{"equal priority label", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging:priority-high", "staging"), map[string]string{"urcomputeringpal/sre": priorityHigh}, 0, false, pr2, "", false},
+			{"grace period", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), map[string]string{"urcomputeringpal/hotfixers": priorityUrgent}, time.Hour, false, pr2, "", true},
+			{"grace period pending", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), map[string]string{"urcomputeringpal/hotfixers": priorityUrgent}, time.Hour, false, pr2, "", true},
+			{"grace period passed", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), map[string]string{"urcomputeringpal/hotfixers": priorityUrgent}, time.Hour, true, pr1, pr2, false},
+		}
+		for _, step := range steps {
+			lm := &LabelMutex{
+				context:      context.Background(),
+				issuesClient: issues,
+				teamsClient:  teams,
+				uriLocker:    locker,
+				event:        step.event,
+				eventName:    "pull_request",
+				label:        "staging",
+				lock:         name,
+				notify:       notifyNone,
+				stealAllowed: []string{"jnewland"},
+				priorities:   step.priorities,
+				gracePeriod:  step.gracePeriod,
+			}
+			if step.expire {
+				records := locker.(recordStore)
+				value, err := json.Marshal(preemptionRecord{By: pr1, From: pr2, At: time.Now().Add(-time.Minute)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := records.PutRecord(lm.preemptionKey(), value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := lm.process(); err != nil {
+				t.Fatalf("%s %s: %+v", locker.Provider(), step.name, err)
+			}
+			if lm.htmlURL != step.htmlURL {
+				t.Errorf("%s %s: html_url: got %v, want %v", locker.Provider(), step.name, lm.htmlURL, step.htmlURL)
+			}
+			if lm.preemptedFrom != step.preemptedFrom {
+				t.Errorf("%s %s: preempted from: got %v, want %v", locker.Provider(), step.name, lm.preemptedFrom, step.preemptedFrom)
+			}
+			if lm.preemptAt.IsZero() == step.preemptAt {
+				t.Errorf("%s %s: preempt at: got %v, want %v", locker.Provider(), step.name, lm.preemptAt, step.preemptAt)
+			}
+		}
+		// each holder was told when the lock was taken from or for it, and pr2 was warned once before it was taken
+		if len(issues.comments[1]) != 2 || len(issues.comments[2]) != 3 {
+			t.Errorf("%s: comments: got %v", locker.Provider(), issues.comments)
+		}
+		if want := []string{"staging", "staging:locked"}; !reflect.DeepEqual(issues.removed[1], want) {
+			t.Errorf("%s: labels removed from pr1: got %v, want %v", locker.Provider(), issues.removed[1], want)
+		}
+	}
+}
+
+func TestPriorityLabels(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	teams := &fakeTeamsClient{members: map[string][]string{"urcomputeringpal/hotfixers": {"jnewland"}}}
+	tests := []struct {
+		name         string
+		priorities   map[string]string
+		stealAllowed []string
+		allowed      []string
+		refused      bool
+	}{
+		{"priority not configured", nil, []string{"jnewland"}, nil, true},
+		{"sender not given the priority", map[string]string{"urcomputeringpal/sre": priorityHigh}, nil, nil, true},
+		{"sender allowed to steal", map[string]string{"urcomputeringpal/sre": priorityHigh}, []string{"jnewland"}, nil, false},
+		{"sender given a higher priority", map[string]string{"urcomputeringpal/sre": priorityHigh, "urcomputeringpal/hotfixers": priorityUrgent}, nil, nil, false},
+		{"sender not allowed to request the lock", map[string]string{"urcomputeringpal/sre": priorityHigh}, []string{"jnewland"}, []string{"urcomputeringpal"}, true},
+	}
+	for _, tt := range tests {
+		issues := newRecordingLabelClient()
+		lm := &LabelMutex{
+			context:           context.Background(),
+			issuesClient:      issues,
+			teamsClient:       teams,
+			uriLocker:         &recordingMemoryLocker{&memoryLocker{value: pr1}, memoryRecords{}},
+			event:             eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging:priority-high", "staging"),
+			eventName:         "pull_request",
+			label:             "staging",
+			lock:              "staging",
+			notify:            notifyNone,
+			priorities:        tt.priorities,
+			stealAllowed:      tt.stealAllowed,
+			allowedRequesters: tt.allowed,
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", tt.name, err)
+		}
+		refused := reflect.DeepEqual(issues.removed[2], []string{"staging:priority-high"}) && len(issues.comments[2]) == 1
+		if refused != tt.refused {
+			t.Errorf("%s: refused: got %v, want %v (removed %v, comments %v)", tt.name, refused, tt.refused, issues.removed, issues.comments)
+		}
+		priority, err := lm.requestPriority()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[bool]string{true: priorityNormal, false: priorityHigh}[tt.refused]; priority != want {
+			t.Errorf("%s: priority: got %v, want %v", tt.name, priority, want)
+		}
+	}
+}
+
+func TestReconcilePreemption(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	event := []byte(`{"schedule": "*/15 * * * *", "repository": {"name": "label-mutex", "owner": {"login": "urcomputeringpal"}}}`)
+	tests := []struct {
+		name          string
+		requester     *github.PullRequest
+		at            time.Time
+		htmlURL       string
+		preemptedFrom string
+		added         map[int][]string
+		removed       map[int][]string
+	}{
+		{"grace period passed", pullRequest(2, "open", "staging", "staging:priority-urgent"), time.Now().Add(-time.Minute), pr2, pr1, map[int][]string{2: {"staging:locked"}}, map[int][]string{1: {"staging", "staging:locked"}}},
+		{"grace period pending", pullRequest(2, "open", "staging", "staging:priority-urgent"), time.Now().Add(time.Hour), pr1, "", map[int][]string{}, map[int][]string{}},
+		{"requester no longer requesting the lock", pullRequest(2, "open", "staging:priority-urgent"), time.Now().Add(-time.Minute), pr1, "", map[int][]string{}, map[int][]string{}},
+	}
+	for _, tt := range tests {
+		locker, err := NewDynamoURILocker("label-mutex", "staging", fmt.Sprintf("%v", uuid.New()), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := locker.Lock(pr1); err != nil {
+			t.Fatal(err)
+		}
+		issues := newRecordingLabelClient()
+		lm := &LabelMutex{
+			context:            context.Background(),
+			issuesClient:       issues,
+			pullRequestsClient: &fakePullRequestsClient{prs: []*github.PullRequest{pullRequest(1, "open", "staging", "staging:locked"), tt.requester}},
+			uriLocker:          locker,
+			event:              event,
+			eventName:          "schedule",
+			label:              "staging",
+			lock:               locker.name,
+			mode:               modeReconcile,
+			notify:             notifyNone,
+			priorities:         map[string]string{"urcomputeringpal/hotfixers": priorityUrgent},
+			gracePeriod:        time.Hour,
+		}
+		value, err := json.Marshal(preemptionRecord{By: pr2, From: pr1, At: tt.at})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := locker.PutRecord(lm.preemptionKey(), value); err != nil {
+			t.Fatal(err)
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", tt.name, err)
+		}
+		if holder, err := locker.Read(); err != nil || holder != tt.htmlURL {
+			t.Errorf("%s: holder: got %v, %v, want %v", tt.name, holder, err, tt.htmlURL)
+		}
+		if lm.preemptedFrom != tt.preemptedFrom {
+			t.Errorf("%s: preempted from: got %v, want %v", tt.name, lm.preemptedFrom, tt.preemptedFrom)
+		}
+		if !reflect.DeepEqual(issues.added, tt.added) {
+			t.Errorf("%s: labels added: got %v, want %v", tt.name, issues.added, tt.added)
+		}
+		if !reflect.DeepEqual(issues.removed, tt.removed) {
+			t.Errorf("%s: labels removed: got %v, want %v", tt.name, issues.removed, tt.removed)
+		}
+		// the preemption is done with once the lock is taken or its requester stops requesting it
+		pending, err := locker.GetRecord(lm.preemptionKey())
+		if err != nil || (len(pending) == 0) != (tt.htmlURL == pr2 || !hasLabel(tt.requester, "staging")) {
+			t.Errorf("%s: preemption record: got %s, %v", tt.name, pending, err)
+		}
+	}
+}
+
+func TestMaxHold(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	schedule := []byte(`{"schedule": "*/15 * * * *", "repository": {"name": "label-mutex", "owner": {"login": "urcomputeringpal"}}}`)
+	issues := newRecordingLabelClient()
+	locker := &recordingMemoryLocker{&memoryLocker{}, memoryRecords{}}
+	steps := []struct {
+		name        string
+		eventName   string
+		event       []byte
+		heldFor     time.Duration
+		htmlURL     string
+		evictedFrom string
+		comments    map[int]int
+	}{
+		{"first request", "pull_request", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), 0, pr1, "", map[int]int{}},
+		{"contested", "pull_request", eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging"), 0, pr1, "", map[int]int{}},
+		{"warned", "pull_request", eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging"), 90 * time.Minute, pr1, "", map[int]int{1: 1}},
+		{"warned once", "pull_request", eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging"), 0, pr1, "", map[int]int{1: 1}},
+		{"evicted by a contested request", "pull_request", eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging"), 3 * time.Hour, pr2, pr1, map[int]int{1: 2}},
+		{"evicted by the reconciler", "schedule", schedule, 3 * time.Hour, "", pr2, map[int]int{1: 2, 2: 1}},
+	}
+	for _, step := range steps {
+		lm := &LabelMutex{
+			context:            context.Background(),
+			issuesClient:       issues,
+			pullRequestsClient: &fakePullRequestsClient{prs: []*github.PullRequest{pullRequest(2, "open", "staging", "staging:locked")}},
+			uriLocker:          locker,
+			event:              step.event,
+			eventName:          step.eventName,
+			label:              "staging",
+			lock:               "staging",
+			notify:             notifyNone,
+			maxHold:            2 * time.Hour,
+		}
+		if step.eventName == "schedule" {
+			lm.mode = modeReconcile
+		}
+		if step.heldFor > 0 {
+			value, err := json.Marshal(holderRecord{Holder: locker.value, Priority: priorityNormal, Since: time.Now().Add(-step.heldFor)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := locker.PutRecord(lm.holderKey(), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", step.name, err)
+		}
+		if lm.htmlURL != step.htmlURL || locker.value != step.htmlURL {
+			t.Errorf("%s: holder: got %v (stored %v), want %v", step.name, lm.htmlURL, locker.value, step.htmlURL)
+		}
+		if lm.evictedFrom != step.evictedFrom || lm.output()["evicted_from"] != step.evictedFrom {
+			t.Errorf("%s: evicted from: got %v, want %v", step.name, lm.evictedFrom, step.evictedFrom)
+		}
+		comments := make(map[int]int)
+		for number, bodies := range issues.comments {
+			comments[number] = len(bodies)
+		}
+		if !reflect.DeepEqual(comments, step.comments) {
+			t.Errorf("%s: comments: got %v, want %v", step.name, issues.comments, step.comments)
+		}
+	}
+	want := map[int][]string{1: {"staging", "staging:locked"}, 2: {"staging", "staging:locked"}}
+	if !reflect.DeepEqual(issues.removed, want) {
+		t.Errorf("labels removed: got %v, want %v", issues.removed, want)
+	}
+}
+
+func TestHoldDeadline(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	tests := []struct {
+		name     string
+		recorded *holderRecord
+		want     holderRecord
+	}{
+		{"no record", nil, holderRecord{Holder: pr1, Priority: priorityNormal, Label: "staging"}},
+		{"another holder's record", &holderRecord{Holder: pr2, Priority: priorityUrgent, Label: "staging"}, holderRecord{Holder: pr1, Priority: priorityNormal, Label: "staging"}},
+		{"record without a start", &holderRecord{Holder: pr1, Priority: priorityHigh, Label: "staging"}, holderRecord{Holder: pr1, Priority: priorityHigh, Label: "staging"}},
+	}
+	for _, test := range tests {
+		records := memoryRecords{}
+		lm := &LabelMutex{
+			label:  "staging",
+			lock:   "staging",
+			holder: pullRequestHolder(&github.PullRequest{HTMLURL: github.String(pr1), Number: github.Int(1)}),
+		}
+		if test.recorded != nil {
+			value, err := json.Marshal(test.recorded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records[lm.holderKey()] = value
+		}
+		if _, err := lm.holdDeadline(records, pr1); err != nil {
+			t.Fatalf("%s: %+v", test.name, err)
+		}
+		var record holderRecord
+		if err := json.Unmarshal(records[lm.holderKey()], &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Since.IsZero() {
+			t.Errorf("%s: expected the hold to have started", test.name)
+		}
+		record.Since = time.Time{}
+		if record != test.want {
+			t.Errorf("%s: record: got %+v, want %+v", test.name, record, test.want)
+		}
+	}
+}
+
+func TestAcquisitionRollback(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	teams := &fakeTeamsClient{members: map[string][]string{"urcomputeringpal/admins": {"jnewland"}}}
+	for _, locker := range []URILocker{uuidLocker(), gcsUUIDLocker()} {
+		issues := newRecordingLabelClient()
+		failing := &failingLabelClient{issues}
+		steps := []struct {
+			name         string
+			event        []byte
+			issuesClient issuesService
+			stealAllowed []string
+			err          bool
+			stored       string
+		}{
+			{"labeling fails", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), failing, nil, true, ""},
+			{"labeling succeeds", eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"), issues, nil, false, pr1},
+			{"labeling the thief fails", eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging:steal"), failing, []string{"urcomputeringpal/admins"}, true, pr1},
+		}
+		var lm *LabelMutex
+		for _, step := range steps {
+			lm = &LabelMutex{
+				context:      context.Background(),
+				issuesClient: step.issuesClient,
+				teamsClient:  teams,
+				uriLocker:    locker,
+				event:        step.event,
+				eventName:    "pull_request",
+				label:        "staging",
+				lock:         "staging",
+				stealAllowed: step.stealAllowed,
+			}
+			err := lm.process()
+			if (err != nil) != step.err {
+				t.Fatalf("%s (%s): error: got %v, want error %v", step.name, locker.Provider(), err, step.err)
+			}
+			stored, err := locker.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored != step.stored || lm.htmlURL != step.stored {
+				t.Errorf("%s (%s): holder: got %q (stored %q), want %q", step.name, locker.Provider(), lm.htmlURL, stored, step.stored)
+			}
+			if lm.output()["stolen_from"] != "" {
+				t.Errorf("%s (%s): outputs.stolen_from: got %v, want none", step.name, locker.Provider(), lm.output()["stolen_from"])
+			}
+		}
+
+		if want := []string{"staging:locked"}; !reflect.DeepEqual(issues.added[1], want) {
+			t.Errorf("%s: labels added to the holder: got %v, want %v", locker.Provider(), issues.added[1], want)
+		}
+		if len(issues.removed[1]) != 0 || len(issues.comments[1]) != 0 {
+			t.Errorf("%s: holder should be left alone: removed %v, comments %v", locker.Provider(), issues.removed[1], issues.comments[1])
+		}
+		value, err := locker.(recordStore).GetRecord(lm.holderKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var record holderRecord
+		if err := json.Unmarshal(value, &record); err != nil || record.Holder != pr1 {
+			t.Errorf("%s: holder record: got %s, want it restored to %s", locker.Provider(), value, pr1)
+		}
+		// the backends' history outlives each run, so only the entries recorded by these steps are read
+		lm.historyLimit = 5
+		if err := lm.readHistory(); err != nil {
+			t.Fatal(err)
+		}
+		var events []string
+		for _, entry := range lm.history {
+			events = append(events, entry.Event)
+		}
+		if want := []string{historyRollback, historySteal, historyAcquire, historyRollback, historyAcquire}; !reflect.DeepEqual(events, want) {
+			t.Errorf("%s: history: got %v, want %v", locker.Provider(), events, want)
+		}
+	}
+}
+
+func TestSlotAndGroupFencingTokens(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	pr3 := "https://github.com/urcomputeringpal/label-mutex/pull/3"
+	for _, newLocker := range []func(name string) URILocker{
+		func(name string) URILocker {
+			locker, err := NewDynamoURILocker("label-mutex", "staging", name, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return locker
+		},
+		func(name string) URILocker {
+			locker, err := NewGCSLocker("label-mutex", name, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return locker
+		},
+	} {
+		name := uuid.New().String()
+		slots := &slotLocker{name: name, slots: []URILocker{newLocker(slotName(name, 0)), newLocker(slotName(name, 1))}}
+		group := newGroupLocker(name+"-group", []namedLocker{{name + "-db", newLocker(name + "-db")}, {name + "-api", newLocker(name + "-api")}})
+		type step struct {
+			release string
+			lock    string
+		}
+		for _, tt := range []struct {
+			locker FencedLocker
+			steps  []step
+		}{
+			{slots, []step{{"", pr1}, {"", pr2}, {pr1, pr3}}},
+			{group, []step{{"", pr1}, {pr1, pr2}, {pr2, pr3}}},
+		} {
+			var tokens []int64
+			for _, step := range tt.steps {
+				if step.release != "" {
+					if _, err := tt.locker.Unlock(step.release); err != nil {
+						t.Fatal(err)
+					}
+				}
+				success, _, err := tt.locker.Lock(step.lock)
+				if err != nil || !success {
+					t.Fatalf("%T (%s): lock %s: %v, %+v", tt.locker, tt.locker.Provider(), step.lock, success, err)
+				}
+				token, err := tt.locker.FencingToken(step.lock)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tokens = append(tokens, token)
+			}
+			if token, err := tt.locker.FencingToken(pr1); err != nil || token != 0 {
+				t.Errorf("%T (%s): released holder's token: got %d, %v, want 0", tt.locker, tt.locker.Provider(), token, err)
+			}
+			if tokens[0] <= 0 || tokens[1] <= tokens[0] || tokens[2] <= tokens[1] {
+				t.Errorf("%T (%s): expected tokens to increase with every holder, got %v", tt.locker, tt.locker.Provider(), tokens)
+			}
+		}
+	}
+}
+
+func TestSharedLocker(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	pr2 := "https://github.com/urcomputeringpal/label-mutex/pull/2"
+	dynamoLocker, err := NewDynamoURILocker("label-mutex", "staging", fmt.Sprintf("%v", uuid.New()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcsLocker, err := NewGCSLocker("label-mutex", fmt.Sprintf("%v", uuid.New()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, locker := range []*sharedLocker{
+		newSharedLocker(dynamoLocker.name, dynamoLocker, dynamoLocker, 0),
+		newSharedLocker(gcsLocker.name, gcsLocker, gcsLocker, 0),
+	} {
+		if _, ok := URILocker(locker).(recordStore); !ok {
+			t.Errorf("%s: shared locker doesn't store records", locker.Provider())
+		}
+		if _, ok := URILocker(locker).(ExpiringLocker); !ok {
+			t.Errorf("%s: shared locker doesn't report expired locks", locker.Provider())
+		}
+		success, _, err := locker.Lock(pr1)
+		if err != nil || !success {
+			t.Fatalf("%s: lock: %v, %+v", locker.Provider(), success, err)
+		}
+		var stealer URILocker = locker
+		stolen, err := stealer.(StealableLocker).Steal(pr1, pr2)
+		if err != nil || !stolen {
+			t.Fatalf("%s: steal: %v, %+v", locker.Provider(), stolen, err)
+		}
+		if holder, err := locker.Read(); err != nil || holder != pr2 {
+			t.Errorf("%s: holder: got %v, %v, want %v", locker.Provider(), holder, err, pr2)
+		}
+		if _, err := locker.Unlock(pr2); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSharedHoldsExpire(t *testing.T) {
+	pr1 := "https://github.com/urcomputeringpal/label-mutex/pull/1"
+	records := memoryRecords{}
+	locker := newSharedLocker("staging", &memoryLocker{}, records, 50*time.Millisecond)
+	for i, created := range []bool{true, false} {
+		success, holder, err := locker.RLock(pr1)
+		if err != nil || success != created || holder != pr1 {
+			t.Errorf("step %d: got %v, %v, %v, want %v", i, success, holder, err, created)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	readers, err := locker.Readers()
+	if err != nil || len(readers) != 0 || len(records) != 0 {
+		t.Errorf("expected the shared hold to have expired, got %v, %v, %v", readers, records, err)
+	}
+	success, _, err := locker.RLock(pr1)
+	if err != nil || !success {
+		t.Errorf("expected the shared hold to be obtained again, got %v, %v", success, err)
+	}
+
+	// readers recorded as a bare URL never expire
+	records[locker.readerKey(pr1)] = []byte(pr1)
+	readers, err = locker.Readers()
+	if err != nil || !reflect.DeepEqual(readers, []string{pr1}) {
+		t.Errorf("got %v, %v, want %v", readers, err, pr1)
+	}
+}
+
+func TestSharedAcquisitionRollback(t *testing.T) {
+	locker := newSharedLocker("staging", &memoryLocker{}, memoryRecords{}, 0)
+	lm := &LabelMutex{
+		context:      context.Background(),
+		issuesClient: &failingLabelClient{newRecordingLabelClient()},
+		uriLocker:    locker,
+		event:        eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging:read"),
+		eventName:    "pull_request",
+		label:        "staging",
+		shared:       true,
+	}
+	if err := lm.process(); err == nil {
+		t.Fatal("expected an error when the holder couldn't be labeled")
+	}
+	readers, err := locker.Readers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readers) != 0 || lm.sharedHold || lm.locked {
+		t.Errorf("shared hold should have been released: readers %v, shared %v, locked %v", readers, lm.sharedHold, lm.locked)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	issues := newRecordingLabelClient()
+	locker := &recordingMemoryLocker{&memoryLocker{}, memoryRecords{}}
+	events := [][]byte{
+		eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"),
+		eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging"),
+		eventWithLabels(t, "testdata/1/pull_request.closed.json", "staging", "staging:locked"),
+		eventWithLabels(t, "testdata/2/pull_request.labeled.json", "staging"),
+	}
+	for i, event := range events {
+		lm := &LabelMutex{
+			context:      context.Background(),
+			issuesClient: issues,
+			uriLocker:    locker,
+			event:        event,
+			eventName:    "pull_request",
+			label:        "staging",
+			lock:         "metrics",
+			notify:       notifyNone,
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("step %d: %+v", i, err)
+		}
+		lm.observe()
+	}
+	for name, tt := range map[string]struct {
+		got  float64
+		want float64
+	}{
+		"attempts":     {testutil.ToFloat64(lockAttempts.WithLabelValues("metrics", "memoryLocker")), 3},
+		"acquisitions": {testutil.ToFloat64(lockAcquisitions.WithLabelValues("metrics", "memoryLocker")), 2},
+		"contentions":  {testutil.ToFloat64(lockContentions.WithLabelValues("metrics", "memoryLocker")), 1},
+		"releases":     {testutil.ToFloat64(lockReleases.WithLabelValues("metrics", "memoryLocker")), 1},
+		"queue length": {testutil.ToFloat64(lockQueueLength.WithLabelValues("metrics", "memoryLocker")), 0},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", name, tt.got, tt.want)
+		}
+	}
+	if count := testutil.CollectAndCount(lockHoldDuration, "label_mutex_lock_hold_duration_seconds"); count != 1 {
+		t.Errorf("hold durations: got %d series, want 1", count)
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	var mu sync.Mutex
+	pushed := make(map[string]map[string]float64)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, _ := url.PathUnescape(r.URL.Path)
+		values := make(map[string]float64)
+		decoder := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			var family dto.MetricFamily
+			if err := decoder.Decode(&family); err != nil {
+				break
+			}
+			// counters and histograms accumulate across tests, so only the gauges' values are compared
+			values[family.GetName()] = family.GetMetric()[0].GetGauge().GetValue()
+		}
+		// grouping labels are pushed in no particular order
+		groups := make(map[string]string)
+		segments := strings.Split(strings.TrimPrefix(path, "/metrics/job/label_mutex/"), "/")
+		for i := 0; i+1 < len(segments); i += 2 {
+			groups[segments[i]] = segments[i+1]
+		}
+		mu.Lock()
+		group := fmt.Sprintf("lock=%s", groups["lock"])
+		if groups["run"] != "" {
+			group = fmt.Sprintf("run=%s", groups["run"])
+		}
+		pushed[fmt.Sprintf("%s repository=%s %s", r.Method, groups["repository@base64"], group)] = values
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	waiting := []waiter{{HTMLURL: "https://github.com/urcomputeringpal/label-mutex/pull/2"}}
+	mutexes := []*LabelMutex{
+		{lock: "staging", uriLocker: &memoryLocker{}, locked: true, waiters: waiting, requested: true, acquiredAt: time.Now()},
+		{lock: "env-preview-1", family: "env:*", uriLocker: &memoryLocker{}, locked: true, waiters: waiting},
+		{lock: "env-preview-2", family: "env:*", uriLocker: &memoryLocker{}, unlocked: true, releases: 1, heldFor: []time.Duration{time.Hour}},
+	}
+	for _, lm := range mutexes {
+		lm.observe()
+	}
+	if got := testutil.ToFloat64(lockQueueLength.WithLabelValues("env:*", "memoryLocker")); got != 1 {
+		t.Errorf("locks created from a pattern should be observed under the pattern: got queue length %v", got)
+	}
+	backendDuration.WithLabelValues("memoryLocker", "Lock", "200").Observe(0.1)
+
+	if err := pushMetrics(server.URL, "urcomputeringpal/label-mutex", "42-1", mutexes); err != nil {
+		t.Fatal(err)
+	}
+	run := "PUT repository=dXJjb21wdXRlcmluZ3BhbC9sYWJlbC1tdXRleA run=42-1"
+	for _, name := range []string{"label_mutex_lock_attempts_total", "label_mutex_lock_acquisitions_total", "label_mutex_lock_releases_total", "label_mutex_lock_hold_duration_seconds", "label_mutex_backend_request_duration_seconds"} {
+		if _, ok := pushed[run][name]; !ok {
+			t.Errorf("expected %s to be pushed for the run, got %v", name, pushed[run])
+		}
+	}
+	if _, ok := pushed[run]["label_mutex_lock_queue_length"]; ok {
+		t.Errorf("expected the queue length to only be pushed for each lock, got %v", pushed[run])
+	}
+	delete(pushed, run)
+	want := map[string]map[string]float64{
+		// urcomputeringpal/label-mutex, base64 encoded as it contains a slash
+		"PUT repository=dXJjb21wdXRlcmluZ3BhbC9sYWJlbC1tdXRleA lock=staging": {"label_mutex_lock_held": 1, "label_mutex_lock_queue_length": 1},
+		"PUT repository=dXJjb21wdXRlcmluZ3BhbC9sYWJlbC1tdXRleA lock=env:*":   {"label_mutex_lock_held": 1, "label_mutex_lock_queue_length": 1},
+	}
+	if !reflect.DeepEqual(pushed, want) {
+		t.Errorf("pushed: got %v, want %v", pushed, want)
+	}
+
+	pushed = make(map[string]map[string]float64)
+	if err := pushMetrics(server.URL, "urcomputeringpal/label-mutex", "", mutexes); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pushed, want) {
+		t.Errorf("pushed without a run: got %v, want %v", pushed, want)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	if _, err := setupTracing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TRACEPARENT", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	dynamoLocker, err := NewDynamoURILocker("label-mutex", "staging", fmt.Sprintf("%v", uuid.New()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcsLocker, err := NewGCSLocker("label-mutex", fmt.Sprintf("%v", uuid.New()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, locker := range []URILocker{dynamoLocker, gcsLocker} {
+		lm := &LabelMutex{
+			context:      contextFromEnvironment(context.Background()),
+			issuesClient: newRecordingLabelClient(),
+			uriLocker:    locker,
+			event:        eventWithLabels(t, "testdata/1/pull_request.labeled.json", "staging"),
+			eventName:    "pull_request",
+			label:        "staging",
+			lock:         "staging",
+		}
+		if err := lm.process(); err != nil {
+			t.Fatalf("%s: %+v", locker.Provider(), err)
+		}
+	}
+	processes := make(map[string]bool)
+	backends := make(map[string]int)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("%s: trace context wasn't propagated: %s", span.Name(), span.SpanContext().TraceID())
+		}
+		if span.Name() == "LabelMutex.process" {
+			processes[span.SpanContext().SpanID().String()] = true
+		}
+	}
+	for _, span := range recorder.Ended() {
+		if processes[span.Parent().SpanID().String()] {
+			backends[strings.Split(span.Name(), ".")[0]]++
+		}
+	}
+	if len(processes) != 2 || backends["dynamo"] == 0 || backends["gcs"] == 0 {
+		t.Errorf("spans beneath LabelMutex.process: got %v", backends)
+	}
+}
@@ -14,3 +14,75 @@ type URILocker interface {
 	// Provider returns the name of the lock provider
 	Provider() string
 }
+
+// SharedLocker allows several URIs to share a lock so long as no URI holds it exclusively
+type SharedLocker interface {
+	URILocker
+
+	// RLock adds the URI to the lock's readers unless another URI holds the lock exclusively, in which case that URI is returned
+	RLock(string) (bool, string, error)
+
+	// RUnlock removes the URI from the lock's readers
+	RUnlock(string) error
+
+	// Readers returns the URIs sharing the lock
+	Readers() ([]string, error)
+}
+
+// FencedLocker issues a fencing token every time a URI obtains the lock. Tokens only ever increase, so a resource
+// protected by the lock can reject writes made by a URI that has since lost it.
+type FencedLocker interface {
+	URILocker
+
+	// FencingToken returns the token issued when the URI obtained the lock, or zero if the URI doesn't hold it
+	FencingToken(string) (int64, error)
+}
+
+// fenceCounter issues fencing tokens from counters stored alongside the locks, for lockers that manage several
+// underlying locks under a single name and need a single sequence of tokens for it
+type fenceCounter interface {
+	// IssueFencingToken increments the counter stored under the key on behalf of the URI, returning the new token
+	IssueFencingToken(key string, uri string) (int64, error)
+}
+
+// StealableLocker allows a lock to be taken from its holder
+type StealableLocker interface {
+	URILocker
+
+	// Steal atomically replaces the holder of the lock with the URI, returning false if the lock is no longer held by the
+	// previous holder
+	Steal(previous string, uri string) (bool, error)
+}
+
+// ExpiringLocker reports locks that expired before their holder released them
+type ExpiringLocker interface {
+	URILocker
+
+	// Expired returns the holder of a lock that expired and was cleared or replaced since it was last called, if any
+	Expired() string
+}
+
+// recordStore persists small records alongside the locks in a backend
+type recordStore interface {
+	// CreateRecord stores the value under the key unless a record already exists, returning whether it was stored
+	CreateRecord(key string, value []byte) (bool, error)
+
+	// PutRecord stores the value under the key, replacing any existing record
+	PutRecord(key string, value []byte) error
+
+	// GetRecord returns the value stored under the key, or nil if there isn't one
+	GetRecord(key string) ([]byte, error)
+
+	// DeleteRecord removes the record stored under the key, if any
+	DeleteRecord(key string) error
+
+	// ListRecords returns the records whose keys start with the prefix, keyed by their full key
+	ListRecords(prefix string) (map[string][]byte, error)
+}
+
+// recordKeyLister is implemented by record stores that read each record with a separate request, letting callers that
+// only need some of the records list their keys and read just those
+type recordKeyLister interface {
+	// ListRecordKeys returns the keys of the records that start with the prefix
+	ListRecordKeys(prefix string) ([]string, error)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// redacted replaces secrets in log output
+const redacted = "[REDACTED]"
+
+// sensitiveMarkers appear in the names of attributes, headers and query parameters that may hold a secret
+var sensitiveMarkers = []string{"token", "secret", "password", "authorization", "signature", "credential", "cookie", "api-key", "apikey"}
+
+// publicNames contain a sensitive marker but never hold a secret. Fencing tokens are sequence numbers issued to holders
+// of a lock, not credentials.
+var publicNames = []string{"fencing_token"}
+
+// isSensitive is true for the names of attributes, headers and query parameters that may hold a secret
+func isSensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, public := range publicNames {
+		if name == public {
+			return false
+		}
+	}
+	for _, marker := range sensitiveMarkers {
+		if strings.Contains(name, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// newLogHandler returns a handler writing records in the format at Info level, or Debug level when debug is true.
+// Attributes that may hold a secret are redacted.
+func newLogHandler(w io.Writer, format string, debug bool) slog.Handler {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	options := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(_ []string, attr slog.Attr) slog.Attr {
+			if isSensitive(attr.Key) {
+				return slog.String(attr.Key, redacted)
+			}
+			return attr
+		},
+	}
+	if format == logFormatJSON {
+		return slog.NewJSONHandler(w, options)
+	}
+	return slog.NewTextHandler(w, options)
+}
+
+// setupLogging makes the handler the default logger, including for libraries still using the log package
+func setupLogging(handler slog.Handler) {
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	log.SetOutput(slogWriter{logger})
+	log.SetFlags(0)
+}
+
+// slogWriter passes lines written by libraries using the log package on to a structured logger
+type slogWriter struct {
+	logger *slog.Logger
+}
+
+func (w slogWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// logger is the logger for messages about the lock, annotated with the lock, its provider, the event being processed
+// and the holder it's being processed for
+func (lm *LabelMutex) logger() *slog.Logger {
+	attrs := []any{"lock", lm.lock, "label", lm.label}
+	if lm.uriLocker != nil {
+		attrs = append(attrs, "provider", lm.uriLocker.Provider())
+	}
+	if lm.eventName != "" {
+		attrs = append(attrs, "event", lm.eventName)
+	}
+	if lm.holder.URL() != "" {
+		attrs = append(attrs, "holder", lm.holder.URL())
+	}
+	return slog.With(attrs...)
+}
+
+// debugTransport logs each request and its response at Debug level, redacting headers and query parameters that may
+// hold a secret
+type debugTransport struct {
+	Transport http.RoundTripper
+}
+
+func (d *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return d.Transport.RoundTrip(req)
+	}
+	start := time.Now()
+	slog.DebugContext(ctx, "HTTP request", "method", req.Method, "url", redactURL(req.URL), "headers", redactHeaders(req.Header))
+	resp, err := d.Transport.RoundTrip(req)
+	if err != nil {
+		slog.DebugContext(ctx, "HTTP request failed", "method", req.Method, "url", redactURL(req.URL), "duration", time.Since(start), "error", err)
+		return resp, err
+	}
+	slog.DebugContext(ctx, "HTTP response", "method", req.Method, "url", redactURL(req.URL), "status", resp.StatusCode, "duration", time.Since(start), "headers", redactHeaders(resp.Header))
+	return resp, err
+}
+
+func redactURL(u *url.URL) string {
+	redactedURL := *u
+	if redactedURL.User != nil {
+		redactedURL.User = url.User(redacted)
+	}
+	query := redactedURL.Query()
+	for name := range query {
+		if isSensitive(name) || name == "key" {
+			query.Set(name, redacted)
+		}
+	}
+	redactedURL.RawQuery = query.Encode()
+	return redactedURL.String()
+}
+
+func redactHeaders(headers http.Header) map[string]string {
+	redactedHeaders := make(map[string]string, len(headers))
+	for name, values := range headers {
+		if isSensitive(name) {
+			redactedHeaders[name] = redacted
+			continue
+		}
+		redactedHeaders[name] = strings.Join(values, ", ")
+	}
+	return redactedHeaders
+}
+
+// logger is the logger for messages about requests a locker makes to its backend
+func (lt *lockerTracer) logger() *slog.Logger {
+	return slog.With("lock", lt.lock, "provider", lt.provider)
+}
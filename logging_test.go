@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugTransportRedactsSecrets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=hunter2")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(newLogHandler(&buf, logFormatJSON, true)))
+	defer slog.SetDefault(defaultLogger)
+
+	client := &http.Client{Transport: &debugTransport{Transport: http.DefaultTransport}}
+	req, err := http.NewRequest("GET", server.URL+"/storage?access_token=hunter2&name=lock", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer hunter2")
+	req.Header.Set("X-Amz-Security-Token", "hunter2")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	slog.Info("Configured", "github_token", "hunter2")
+
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Errorf("secret logged: %s", buf.String())
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d log lines, want 3: %s", len(lines), buf.String())
+	}
+	var response map[string]any
+	if err := json.Unmarshal([]byte(lines[1]), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response["level"] != "DEBUG" || response["status"] != float64(http.StatusNoContent) || !strings.Contains(response["url"].(string), "name=lock") {
+		t.Errorf("response: got %v", response)
+	}
+}
+
+func TestDebugTransportQuietWithoutDebug(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(newLogHandler(&buf, logFormatText, false)))
+	defer slog.SetDefault(defaultLogger)
+
+	client := &http.Client{Transport: &debugTransport{Transport: http.DefaultTransport}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if buf.Len() != 0 {
+		t.Errorf("got %q, want no output", buf.String())
+	}
+}
+
+func TestLoggerFields(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(newLogHandler(&buf, logFormatJSON, false)))
+	defer slog.SetDefault(defaultLogger)
+
+	lm := &LabelMutex{
+		context:   context.Background(),
+		uriLocker: &memoryLocker{},
+		label:     "staging",
+		lock:      "staging",
+		eventName: "pull_request",
+		holder:    &holder{htmlURL: "https://github.com/urcomputeringpal/label-mutex/pull/1"},
+	}
+	lm.logger().Info("Lock obtained", "fencing_token", 7, "token", "ghp_secret")
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"msg":      "Lock obtained",
+		"lock":     "staging",
+		"provider": "memoryLocker",
+		"event":    "pull_request",
+		"holder":   "https://github.com/urcomputeringpal/label-mutex/pull/1",
+	} {
+		if record[key] != want {
+			t.Errorf("%s: got %v, want %v", key, record[key], want)
+		}
+	}
+	if record["fencing_token"] != float64(7) {
+		t.Errorf("fencing_token: got %v, want it logged", record["fencing_token"])
+	}
+	if record["token"] != redacted {
+		t.Errorf("token: got %v, want it redacted", record["token"])
+	}
+}
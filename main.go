@@ -2,9 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/go-github/v55/github"
 	"github.com/hashicorp/go-multierror"
@@ -13,64 +19,238 @@ import (
 )
 
 func main() {
+	logFormat := githubactions.GetInput("log_format")
+	// GitHub sets RUNNER_DEBUG when a run is re-run with debug logging enabled
+	debug := githubactions.GetInput("debug") == "true" || os.Getenv("RUNNER_DEBUG") == "1"
+	setupLogging(newLogHandler(os.Stderr, logFormat, debug))
+	if logFormat != "" && logFormat != logFormatText && logFormat != logFormatJSON {
+		githubactions.Fatalf("input 'log_format' must be one of '%s' or '%s'", logFormatText, logFormatJSON)
+	}
+
 	c := &config{
-		githubToken: githubactions.GetInput("GITHUB_TOKEN"),
-		label:       githubactions.GetInput("label"),
-		table:       githubactions.GetInput("table"),
-		partition:   githubactions.GetInput("partition"),
-		bucket:      githubactions.GetInput("bucket"),
-		lock:        githubactions.GetInput("lock"),
+		githubToken:    githubactions.GetInput("GITHUB_TOKEN"),
+		label:          githubactions.GetInput("label"),
+		table:          githubactions.GetInput("table"),
+		partition:      githubactions.GetInput("partition"),
+		bucket:         githubactions.GetInput("bucket"),
+		lock:           githubactions.GetInput("lock"),
+		environment:    githubactions.GetInput("environment"),
+		onConflict:     githubactions.GetInput("on_conflict"),
+		configFile:     githubactions.GetInput("config_file"),
+		shared:         githubactions.GetInput("shared") == "true",
+		labelPattern:   githubactions.GetInput("label_pattern") == "true",
+		permission:     githubactions.GetInput("permission"),
+		mode:           githubactions.GetInput("mode"),
+		notify:         githubactions.GetInput("notify"),
+		holder:         githubactions.GetInput("holder"),
+		unlock:         githubactions.GetInput("unlock") == "true",
+		calendar:       githubactions.GetInput("calendar"),
+		reason:         githubactions.GetInput("reason"),
+		priority:       githubactions.GetInput("priority"),
+		listen:         githubactions.GetInput("listen"),
+		webhookSecret:  githubactions.GetInput("webhook_secret"),
+		pushgatewayURL: githubactions.GetInput("pushgateway_url"),
+		githubRetries:  defaultGitHubRetries,
+	}
+	for input, t := range map[string]*time.Time{"start": &c.start, "end": &c.end} {
+		if value := githubactions.GetInput(input); value != "" {
+			parsed, parseErr := time.Parse(time.RFC3339, value)
+			if parseErr != nil {
+				githubactions.Fatalf("input '%s' must be an RFC 3339 time: %+v", input, parseErr)
+			}
+			*t = parsed
+		}
+	}
+	if historyLimit := githubactions.GetInput("history_limit"); historyLimit != "" {
+		limit, parseErr := strconv.Atoi(historyLimit)
+		if parseErr != nil {
+			githubactions.Fatalf("input 'history_limit' must be a number: %+v", parseErr)
+		}
+		c.historyLimit = limit
+	}
+	if githubRetries := githubactions.GetInput("github_retries"); githubRetries != "" {
+		retries, parseErr := strconv.Atoi(githubRetries)
+		if parseErr != nil {
+			githubactions.Fatalf("input 'github_retries' must be a number: %+v", parseErr)
+		}
+		c.githubRetries = retries
+	}
+	if priorities := githubactions.GetInput("priorities"); priorities != "" {
+		c.priorities = make(map[string]string)
+		for _, entry := range strings.Split(priorities, ",") {
+			requester, level, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok {
+				githubactions.Fatalf("input 'priorities' must be a comma separated list of 'requester=priority': %s", entry)
+			}
+			c.priorities[requester] = level
+		}
+	}
+	for input, duration := range map[string]*time.Duration{"grace_period": &c.gracePeriod, "max_hold": &c.maxHold, "max_hold_warning": &c.maxHoldWarning, "github_retry_delay": &c.githubRetryDelay} {
+		if value := githubactions.GetInput(input); value != "" {
+			parsed, parseErr := time.ParseDuration(value)
+			if parseErr != nil {
+				githubactions.Fatalf("input '%s' must be a duration: %+v", input, parseErr)
+			}
+			*duration = parsed
+		}
+	}
+	if allowed := githubactions.GetInput("allowed"); allowed != "" {
+		c.allowed = strings.Split(allowed, ",")
+	}
+	if stealAllowed := githubactions.GetInput("steal_allowed"); stealAllowed != "" {
+		c.stealAllowed = strings.Split(stealAllowed, ",")
 	}
 	err := c.Validate()
 	if err != nil {
 		githubactions.Fatalf("failed to validate input: %+v", err)
 	}
+	locks, err := c.locks()
+	if err != nil {
+		githubactions.Fatalf("failed to validate input: %+v", err)
+	}
 
-	var uriLocker URILocker
-	var initErr error
-	if c.bucket == "" {
-		uriLocker, initErr = NewDynamoURILocker(c.table, c.partition, c.lock)
-	} else {
-		uriLocker, initErr = NewGCSLocker(c.bucket, c.lock)
+	ctx := context.Background()
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		githubactions.Fatalf("failed to set up tracing: %+v", err)
 	}
-	if initErr != nil {
-		githubactions.Fatalf("failed to initialize: %+v", err)
+	client := c.githubClient(ctx)
+	if c.mode == modeServer {
+		err = c.serve(ctx, client, locks)
+		githubactions.Fatalf("server stopped: %+v", err)
 	}
 
 	event, err := ioutil.ReadFile(os.Getenv("GITHUB_EVENT_PATH"))
 	if err != nil {
 		githubactions.Fatalf("Couldn't read event: %+v", err)
 	}
+	// locks that couldn't be processed still have their outputs written and are reported before failing the run
+	mutexes, processErr := c.processEvent(contextFromEnvironment(ctx), client, locks, os.Getenv("GITHUB_EVENT_NAME"), event)
+	if shutdownErr := shutdownTracing(ctx); shutdownErr != nil {
+		githubactions.Warningf("Couldn't export traces: %+v", shutdownErr)
+	}
+	if c.pushgatewayURL != "" {
+		err = pushMetrics(c.pushgatewayURL, os.Getenv("GITHUB_REPOSITORY"), metricsRun(), mutexes)
+		if err != nil {
+			githubactions.Warningf("Couldn't push metrics to %s: %+v", c.pushgatewayURL, err)
+		}
+	}
 
-	ctx := context.Background()
-	client := c.githubClient(ctx)
-
-	labelMutex := &LabelMutex{
-		context:            ctx,
-		issuesClient:       client.Issues,
-		pullRequestsClient: client.PullRequests,
-		uriLocker:          uriLocker,
-		label:              c.label,
-		event:              event,
-		eventName:          os.Getenv("GITHUB_EVENT_NAME"),
-	}
-	err = labelMutex.process()
+	output, err := outputs(mutexes, c.configFile != "" || c.labelPattern)
 	if err != nil {
-		githubactions.Fatalf("error while processing event: %+v", err)
+		githubactions.Fatalf("failed to render outputs: %+v", err)
 	}
-	output := labelMutex.output()
 	for k, v := range output {
 		githubactions.SetOutput(k, v)
 	}
+	report(githubactions.New(), mutexes)
+	if processErr != nil {
+		githubactions.Fatalf("%+v", processErr)
+	}
+	for _, labelMutex := range mutexes {
+		if labelMutex.failed() {
+			os.Exit(1)
+		}
+	}
+}
+
+// processEvent processes the event for each of the locks, returning the locks that were processed. Every lock is
+// processed even when some fail, with their errors combined.
+func (c *config) processEvent(ctx context.Context, client *github.Client, locks []lockConfig, eventName string, event []byte) ([]*LabelMutex, error) {
+	var mutexes []*LabelMutex
+	var resultErr *multierror.Error
+	for _, lc := range locks {
+		labelMutex, err := lc.newLabelMutex()
+		if err != nil {
+			resultErr = multierror.Append(resultErr, fmt.Errorf("failed to initialize lock '%s': %+v", lc.Label, err))
+			continue
+		}
+		labelMutex.context = ctx
+		labelMutex.issuesClient = client.Issues
+		labelMutex.pullRequestsClient = client.PullRequests
+		labelMutex.deploymentsClient = client.Repositories
+		labelMutex.teamsClient = client.Teams
+		labelMutex.permissionsClient = client.Repositories
+		labelMutex.event = event
+		labelMutex.eventName = eventName
+		labelMutex.mode = c.mode
+		labelMutex.historyLimit = c.historyLimit
+		labelMutex.holderURL = c.holder
+		labelMutex.unlock = c.unlock
+		labelMutex.pendingReservation = reservation{Start: c.start, End: c.end, Holder: c.holder, Reason: c.reason}
+		if c.mode == modeServer {
+			labelMutex.mode = modeLock
+		}
+		err = labelMutex.process()
+		for _, lm := range labelMutex.mutexes() {
+			lm.observe()
+		}
+		if err != nil {
+			resultErr = multierror.Append(resultErr, fmt.Errorf("error while processing event for lock '%s': %+v", lc.Label, err))
+		}
+		mutexes = append(mutexes, labelMutex.mutexes()...)
+	}
+	return mutexes, resultErr.ErrorOrNil()
+}
+
+// outputs combines the outputs of each lock. When perLock is true, each output is prefixed with the name of its lock.
+// The 'locks' output always contains the outputs of every lock as JSON.
+func outputs(mutexes []*LabelMutex, perLock bool) (map[string]string, error) {
+	output := make(map[string]string)
+	combined := make(map[string]map[string]string)
+	for _, lm := range mutexes {
+		lockOutput := lm.output()
+		combined[lm.lock] = lockOutput
+		for k, v := range lockOutput {
+			if perLock {
+				output[fmt.Sprintf("%s_%s", lm.lock, k)] = v
+			} else {
+				output[k] = v
+			}
+		}
+	}
+	locksJSON, err := json.Marshal(combined)
+	if err != nil {
+		return nil, err
+	}
+	output["locks"] = string(locksJSON)
+	return output, nil
 }
 
 type config struct {
-	githubToken string
-	label       string
-	table       string
-	partition   string
-	bucket      string
-	lock        string
+	githubToken      string
+	label            string
+	table            string
+	partition        string
+	bucket           string
+	lock             string
+	environment      string
+	onConflict       string
+	configFile       string
+	shared           bool
+	labelPattern     bool
+	stealAllowed     []string
+	allowed          []string
+	permission       string
+	mode             string
+	historyLimit     int
+	notify           string
+	holder           string
+	unlock           bool
+	calendar         string
+	start            time.Time
+	end              time.Time
+	reason           string
+	priority         string
+	priorities       map[string]string
+	gracePeriod      time.Duration
+	maxHold          time.Duration
+	maxHoldWarning   time.Duration
+	listen           string
+	webhookSecret    string
+	pushgatewayURL   string
+	githubRetries    int
+	githubRetryDelay time.Duration
 }
 
 func (c *config) Validate() error {
@@ -78,28 +258,118 @@ func (c *config) Validate() error {
 	if c.githubToken == "" {
 		resultErr = multierror.Append(resultErr, errors.New("input 'GITHUB_TOKEN' missing"))
 	}
+	if c.onConflict == "" {
+		c.onConflict = onConflictWarn
+	}
+	if c.partition == "" {
+		c.partition = c.bucket
+	}
+	if c.notify == "" {
+		c.notify = notifyComment
+	}
+	if c.mode == "" {
+		c.mode = modeLock
+	}
+	switch c.mode {
+	case modeLock, modeReconcile, modeHistory, modeReserve, modeUnreserve, modeServer:
+	default:
+		resultErr = multierror.Append(resultErr, fmt.Errorf("input 'mode' must be one of '%s', '%s', '%s', '%s', '%s' or '%s'", modeLock, modeReconcile, modeHistory, modeReserve, modeUnreserve, modeServer))
+	}
+	if c.mode == modeServer && c.listen == "" {
+		c.listen = defaultListen
+	}
+	if c.mode == modeServer && c.webhookSecret == "" {
+		resultErr = multierror.Append(resultErr, errors.New("input 'webhook_secret' is required in 'server' mode"))
+	}
+	if c.mode == modeReserve && (c.start.IsZero() || !c.end.After(c.start)) {
+		resultErr = multierror.Append(resultErr, errors.New("inputs 'start' and 'end' are required in 'reserve' mode, and 'end' must be after 'start'"))
+	}
+	if c.mode == modeUnreserve && c.start.IsZero() {
+		resultErr = multierror.Append(resultErr, errors.New("input 'start' is required in 'unreserve' mode"))
+	}
+	if c.githubRetries < 0 {
+		resultErr = multierror.Append(resultErr, errors.New("input 'github_retries' can't be negative"))
+	}
+	if c.githubRetryDelay < 0 {
+		resultErr = multierror.Append(resultErr, errors.New("input 'github_retry_delay' can't be negative"))
+	} else if c.githubRetryDelay == 0 {
+		c.githubRetryDelay = defaultGitHubRetryDelay
+	}
+	if c.historyLimit < 0 {
+		resultErr = multierror.Append(resultErr, errors.New("input 'history_limit' can't be negative"))
+	}
+	if c.unlock && c.holder == "" {
+		resultErr = multierror.Append(resultErr, errors.New("input 'unlock' requires 'holder'"))
+	}
+	if c.configFile != "" {
+		return resultErr.ErrorOrNil()
+	}
 	if c.label == "" {
 		resultErr = multierror.Append(resultErr, errors.New("input 'label' missing"))
 	}
 	if c.table == "" && c.bucket == "" {
 		resultErr = multierror.Append(resultErr, errors.New("either 'table' or 'bucket' is required"))
 	}
-	if c.partition == "" {
-		c.partition = c.bucket
-	}
 	if c.partition == "" {
 		resultErr = multierror.Append(resultErr, errors.New("input 'partition' missing"))
 	}
-	if c.lock == "" {
+	if c.lock == "" && !c.labelPattern {
 		resultErr = multierror.Append(resultErr, errors.New("input 'lock' missing"))
 	}
+	switch c.onConflict {
+	case onConflictFail, onConflictWarn, onConflictIgnore:
+	default:
+		resultErr = multierror.Append(resultErr, fmt.Errorf("input 'on_conflict' must be one of '%s', '%s' or '%s'", onConflictFail, onConflictWarn, onConflictIgnore))
+	}
 	return resultErr.ErrorOrNil()
 }
 
+// locks returns the locks declared in 'config_file', or the single lock described by the action's inputs
+func (c *config) locks() ([]lockConfig, error) {
+	defaults := lockConfig{
+		Name:           c.lock,
+		Label:          c.label,
+		Pattern:        c.labelPattern,
+		Table:          c.table,
+		Partition:      c.partition,
+		Bucket:         c.bucket,
+		Environment:    c.environment,
+		OnConflict:     c.onConflict,
+		Shared:         c.shared,
+		StealAllowed:   c.stealAllowed,
+		Allowed:        c.allowed,
+		Permission:     c.permission,
+		Notify:         c.notify,
+		Calendar:       c.calendar,
+		Priority:       c.priority,
+		Priorities:     c.priorities,
+		GracePeriod:    c.gracePeriod,
+		MaxHold:        c.maxHold,
+		MaxHoldWarning: c.maxHoldWarning,
+	}
+	if c.configFile != "" {
+		return loadLockConfigs(c.configFile, defaults)
+	}
+	if strings.Contains(c.lock, ",") {
+		defaults.Name = ""
+		for _, name := range strings.Split(c.lock, ",") {
+			defaults.Locks = append(defaults.Locks, strings.TrimSpace(name))
+		}
+	}
+	defaults.applyDefaults(lockConfig{})
+	return []lockConfig{defaults}, defaults.Validate()
+}
+
 func (c *config) githubClient(ctx context.Context) *github.Client {
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: c.githubToken},
 	)
+	transport := &retryTransport{
+		Transport: tracedTransport("github", &debugTransport{Transport: http.DefaultTransport}),
+		retries:   c.githubRetries,
+		delay:     c.githubRetryDelay,
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
 	tc := oauth2.NewClient(ctx, ts)
 	return github.NewClient(tc)
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// defaultMaxHoldWarning is how long before eviction holders are warned when 'max_hold_warning' isn't set
+var defaultMaxHoldWarning = time.Hour
+
+func (lm *LabelMutex) evictionWarningKey() string {
+	return fmt.Sprintf("%s.eviction_warning", lm.lock)
+}
+
+// holdDeadline returns when the current holder will have held the lock for longer than max_hold. The clock starts
+// when the holder is first seen if it obtained the lock without recording when, keeping what was recorded about it.
+func (lm *LabelMutex) holdDeadline(records recordStore, current string) (time.Time, error) {
+	value, err := records.GetRecord(lm.holderKey())
+	if err != nil {
+		return time.Time{}, err
+	}
+	var record holderRecord
+	if len(value) > 0 {
+		if err := json.Unmarshal(value, &record); err != nil {
+			lm.logger().Warn("Ignoring unreadable holder record", "error", err)
+		}
+	}
+	if record.Holder != current {
+		record = holderRecord{Holder: current, Priority: lm.defaultPriority()}
+		if current == lm.holder.URL() && lm.holder.Number() != 0 {
+			record.Label = lm.label
+		}
+	}
+	if record.Since.IsZero() {
+		record.Since = time.Now().UTC()
+		value, err = json.Marshal(record)
+		if err == nil {
+			err = records.PutRecord(lm.holderKey(), value)
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return record.Since.Add(lm.maxHold), nil
+}
+
+// enforceMaxHold evicts the current holder of the lock once it has held the lock for longer than max_hold, warning it
+// ahead of time. It returns true when the holder was evicted.
+func (lm *LabelMutex) enforceMaxHold(current string) (bool, error) {
+	if lm.maxHold <= 0 || current == "" {
+		return false, nil
+	}
+	records, ok := lm.records()
+	if !ok {
+		return false, nil
+	}
+	deadline, err := lm.holdDeadline(records, current)
+	if err != nil {
+		return false, err
+	}
+	warning := lm.maxHoldWarning
+	if warning <= 0 {
+		warning = defaultMaxHoldWarning
+	}
+	now := time.Now()
+	switch {
+	case !now.Before(deadline):
+		return true, lm.evict(records, current)
+	case !now.Before(deadline.Add(-warning)):
+		return false, lm.warnEviction(records, current, deadline)
+	}
+	return false, nil
+}
+
+// warnEviction lets the current holder know when it will be evicted, once per holder
+func (lm *LabelMutex) warnEviction(records recordStore, current string, deadline time.Time) error {
+	warned, err := records.GetRecord(lm.evictionWarningKey())
+	if err != nil || string(warned) == current {
+		return err
+	}
+	err = records.PutRecord(lm.evictionWarningKey(), []byte(current))
+	if err != nil {
+		return err
+	}
+	lm.logger().Info("Warning holder of its eviction", "current_holder", current, "evict_at", formatTime(deadline))
+	_, _, number, err := parseIssueURL(current)
+	if err != nil {
+		lm.logger().Warn("Can't warn holder of its eviction", "current_holder", current, "error", err)
+		return nil
+	}
+	return lm.comment(number, fmt.Sprintf("This holder will have held the `%s` lock for longer than %s at %s and will be evicted then. Release it before then by removing `%s`.", lm.label, lm.maxHold, formatTime(deadline), lm.label))
+}
+
+// evict releases the lock held by the current holder for longer than max_hold, removes the labels representing the
+// lock from it and lets it know why
+func (lm *LabelMutex) evict(records recordStore, current string) error {
+	lm.logger().Info("Lock held for longer than max_hold, evicting", "current_holder", current, "max_hold", lm.maxHold)
+	_, err := lm.uriLocker.Unlock(current)
+	if err != nil {
+		return err
+	}
+	lm.evictedFrom = current
+	lm.recordHistory(historyEvict, current)
+
+	var resultErr *multierror.Error
+	err = records.DeleteRecord(lm.evictionWarningKey())
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	evicted := &holder{htmlURL: current, owner: lm.holder.Owner(), repo: lm.holder.Repo()}
+	requester := lm.holder
+	lm.holder = evicted
+	err = lm.deactivateDeployments()
+	lm.holder = requester
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	_, _, number, err := parseIssueURL(current)
+	if err != nil {
+		lm.logger().Warn("Can't let holder know it was evicted", "current_holder", current, "error", err)
+		return resultErr.ErrorOrNil()
+	}
+	for _, label := range []string{lm.label, fmt.Sprintf("%s:%s", lm.label, lockedSuffix)} {
+		err = lm.removeLabelFrom(number, label)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	err = lm.comment(number, fmt.Sprintf("This holder held the `%s` lock for longer than %s, so it was released. Add `%s` again to wait for it.", lm.label, lm.maxHold, lm.label))
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	return resultErr.ErrorOrNil()
+}
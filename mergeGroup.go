@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v55/github"
+	"github.com/hashicorp/go-multierror"
+)
+
+// mergeGroupRefPattern matches the number of the PR a merge group was created for in its head ref, e.g.
+// refs/heads/gh-readonly-queue/main/pr-123-f9748b56ccc9c49cab08e40c014a5e7cec1feeb4
+var mergeGroupRefPattern = regexp.MustCompile(`/pr-(\d+)-[0-9a-f]+$`)
+
+type mergeGroupEvent struct {
+	github.MergeGroupEvent
+	// Reason is set when a merge group is destroyed: merged, invalidated or dequeued
+	Reason string `json:"reason"`
+}
+
+// processMergeGroup obtains the lock on behalf of the PR a merge group was created for when the group's checks are
+// requested, and releases it once the group is merged or destroyed
+func (lm *LabelMutex) processMergeGroup() error {
+	var event mergeGroupEvent
+	err := json.Unmarshal(lm.event, &event)
+	if err != nil {
+		return err
+	}
+	lm.action = event.GetAction()
+	headRef := event.GetMergeGroup().GetHeadRef()
+	match := mergeGroupRefPattern.FindStringSubmatch(headRef)
+	if match == nil {
+		lm.logger().Info("Couldn't find the PR the merge group was created for, doing nothing", "head_ref", headRef)
+		return lm.processOther()
+	}
+	number, err := strconv.Atoi(match[1])
+	if err != nil {
+		return err
+	}
+	pr, _, err := lm.pullRequestsClient.Get(lm.context, event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName(), number)
+	if err != nil {
+		return err
+	}
+	lm.holder = pullRequestHolder(pr)
+	lm.fork = isFork(pr)
+
+	switch lm.action {
+	case "checks_requested":
+		return lm.obtainForMergeGroup(event.GetMergeGroup())
+	case "destroyed":
+		lm.logger().Info("Merge group destroyed", "head_ref", headRef, "reason", event.Reason)
+		return lm.releaseForMergeGroup()
+	}
+	lm.logger().Info("Ignoring merge group event", "action", lm.action)
+	return lm.processOther()
+}
+
+// obtainForMergeGroup obtains the lock on behalf of the group's PR, labeling the PR as if it had requested the lock so
+// that it's released when the PR is closed
+func (lm *LabelMutex) obtainForMergeGroup(group *github.MergeGroup) error {
+	lockValue := lm.holder.URL()
+	lm.requested = true
+	lm.logger().Info("Merge group requested checks, locking", "sha", group.GetHeadSHA())
+	reservation := lm.reserved(lockValue)
+	if reservation != nil {
+		return lm.refuseReserved(reservation)
+	}
+	success, existingValue, err := lm.uriLocker.Lock(lockValue)
+	if err != nil {
+		return err
+	}
+	if !success && existingValue != lockValue {
+		lm.logger().Info("Lock claimed by another holder", "current_holder", existingValue)
+		lm.locked = true
+		lm.htmlURL = existingValue
+		lm.recordHistory(historyRefuse, lockValue)
+		return nil
+	}
+	lm.locked = true
+	lm.htmlURL = lockValue
+	if !success {
+		lm.logger().Info("Lock already held")
+		return lm.ensureDeployment()
+	}
+	lm.logger().Info("Lock obtained")
+	lm.acquiredAt = time.Now()
+	lm.recordHistory(historyAcquire, lockValue)
+	err = lm.confirmAcquisition(lockValue, "", lm.label, fmt.Sprintf("%s:%s", lm.label, lockedSuffix))
+	if err != nil {
+		return err
+	}
+	return lm.ensureDeployment()
+}
+
+// releaseForMergeGroup releases the lock if it's held by the group's PR
+func (lm *LabelMutex) releaseForMergeGroup() error {
+	var resultErr *multierror.Error
+	lockValue := lm.holder.URL()
+	lm.logger().Info("Unlocking")
+	existing, err := lm.uriLocker.Unlock(lockValue)
+	if existing != "" && existing != lockValue {
+		lm.logger().Info("Lock claimed by another holder", "current_holder", existing)
+		lm.locked = true
+		lm.htmlURL = existing
+		return nil
+	}
+	if err != nil && existing != "" {
+		return err
+	}
+	lm.locked = false
+	lm.unlocked = true
+	if err != nil {
+		lm.logger().Info("Lock was already unlocked")
+	} else {
+		lm.logger().Info("Unlocked")
+		lm.released = true
+		lm.recordHistory(historyRelease, lockValue)
+		err = lm.notifyWaiters(lockValue)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	err = lm.deactivateDeployments()
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	for _, label := range []string{lm.label, fmt.Sprintf("%s:%s", lm.label, lockedSuffix)} {
+		err = lm.removeLabel(label)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	return resultErr.ErrorOrNil()
+}
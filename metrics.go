@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/hashicorp/go-multierror"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// metricsRegistry holds the metrics describing the locks processed by this process, served on /metrics in server mode
+// and pushed to a Pushgateway after one-shot runs
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	lockAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "label_mutex_lock_attempts_total",
+		Help: "Requests for a lock.",
+	}, []string{"lock", "provider"})
+	lockAcquisitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "label_mutex_lock_acquisitions_total",
+		Help: "Requests that obtained a lock.",
+	}, []string{"lock", "provider"})
+	lockContentions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "label_mutex_lock_contentions_total",
+		Help: "Requests refused because a lock was held by someone else.",
+	}, []string{"lock", "provider"})
+	lockReleases = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "label_mutex_lock_releases_total",
+		Help: "Locks released by or taken from their holder.",
+	}, []string{"lock", "provider"})
+	lockHoldDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "label_mutex_lock_hold_duration_seconds",
+		Help:    "How long locks were held before they were released.",
+		Buckets: []float64{60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400, 172800, 604800},
+	}, []string{"lock", "provider"})
+	lockQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "label_mutex_lock_queue_length",
+		Help: "Requests waiting on a lock.",
+	}, []string{"lock", "provider"})
+	backendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "label_mutex_backend_request_duration_seconds",
+		Help:    "Latency of requests made to the backends storing locks.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider", "operation", "code"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(lockAttempts, lockAcquisitions, lockContentions, lockReleases, lockHoldDuration, lockQueueLength, backendDuration)
+}
+
+// measureRelease counts a release of the lock from the URI, measuring how long it held the lock when its holder
+// record says so
+func (lm *LabelMutex) measureRelease(uri string) {
+	lm.releases++
+	records, ok := lm.records()
+	if !ok {
+		return
+	}
+	value, err := records.GetRecord(lm.holderKey())
+	if err != nil || len(value) == 0 {
+		return
+	}
+	var record holderRecord
+	if err := json.Unmarshal(value, &record); err != nil || record.Holder != uri || record.Since.IsZero() {
+		return
+	}
+	lm.heldFor = append(lm.heldFor, time.Since(record.Since))
+}
+
+// observe updates the metrics describing the lock with the outcome of processing an event
+func (lm *LabelMutex) observe() {
+	if lm.uriLocker == nil {
+		return
+	}
+	labels := prometheus.Labels{"lock": lm.metricsLock(), "provider": lm.uriLocker.Provider()}
+	if lm.requested {
+		lockAttempts.With(labels).Inc()
+	}
+	if !lm.acquiredAt.IsZero() {
+		lockAcquisitions.With(labels).Inc()
+	}
+	if lm.refused() {
+		lockContentions.With(labels).Inc()
+	}
+	lockReleases.With(labels).Add(float64(lm.releases))
+	for _, held := range lm.heldFor {
+		lockHoldDuration.With(labels).Observe(held.Seconds())
+	}
+	if lm.waiters != nil {
+		lockQueueLength.With(labels).Set(float64(len(lm.waiters)))
+	}
+}
+
+// metricsLock names the lock in metrics. Locks created from a label pattern are named by the pattern, so that each
+// label matching it doesn't add series of its own.
+func (lm *LabelMutex) metricsLock() string {
+	if lm.family != "" {
+		return lm.family
+	}
+	return lm.lock
+}
+
+// metricsRun identifies the workflow run pushing metrics, including its attempt so that re-runs don't replace the
+// metrics pushed by the original run
+func metricsRun() string {
+	run := os.Getenv("GITHUB_RUN_ID")
+	if run != "" && os.Getenv("GITHUB_RUN_ATTEMPT") != "" {
+		run = fmt.Sprintf("%s-%s", run, os.Getenv("GITHUB_RUN_ATTEMPT"))
+	}
+	return run
+}
+
+// pushMetrics pushes the state of the locks processed by a one-shot run to a Pushgateway. Each lock is pushed to a
+// group of its own, replacing the state pushed for it by earlier runs, so that runs processing different locks don't
+// overwrite each other. Counters and histograms only describe a single run, so they're pushed to a group keyed by the
+// run to be summed across runs, and aren't pushed by runs that can't be identified.
+func pushMetrics(url string, repository string, run string, mutexes []*LabelMutex) error {
+	var names []string
+	providers := make(map[string]string)
+	held := make(map[string]float64)
+	queued := make(map[string]float64)
+	for _, lm := range mutexes {
+		if lm.uriLocker == nil {
+			continue
+		}
+		name := lm.metricsLock()
+		if _, ok := providers[name]; !ok {
+			names = append(names, name)
+		}
+		providers[name] = lm.uriLocker.Provider()
+		if lm.locked {
+			held[name]++
+		}
+		if lm.waiters != nil {
+			queued[name] += float64(len(lm.waiters))
+		}
+	}
+
+	var resultErr *multierror.Error
+	for _, name := range names {
+		labels := prometheus.Labels{"provider": providers[name]}
+		heldGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "label_mutex_lock_held",
+			Help:        "Whether a lock is held, or how many locks created from a label pattern are.",
+			ConstLabels: labels,
+		})
+		heldGauge.Set(held[name])
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(heldGauge)
+		if queue, ok := queued[name]; ok {
+			queueGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+				Name:        "label_mutex_lock_queue_length",
+				Help:        "Requests waiting on a lock.",
+				ConstLabels: labels,
+			})
+			queueGauge.Set(queue)
+			registry.MustRegister(queueGauge)
+		}
+		err := push.New(url, "label_mutex").
+			Gatherer(registry).
+			Grouping("repository", repository).
+			Grouping("lock", name).
+			Push()
+		if err != nil {
+			resultErr = multierror.Append(resultErr, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	if run != "" {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(lockAttempts, lockAcquisitions, lockContentions, lockReleases, lockHoldDuration, backendDuration)
+		err := push.New(url, "label_mutex").
+			Gatherer(registry).
+			Grouping("repository", repository).
+			Grouping("run", run).
+			Push()
+		if err != nil {
+			resultErr = multierror.Append(resultErr, fmt.Errorf("run %s: %w", run, err))
+		}
+	}
+	return resultErr.ErrorOrNil()
+}
+
+// observeDynamoRequest measures the latency of requests made to DynamoDB
+func observeDynamoRequest(r *request.Request) {
+	code := "error"
+	if r.HTTPResponse != nil {
+		code = strconv.Itoa(r.HTTPResponse.StatusCode)
+	}
+	backendDuration.WithLabelValues("dynamo", r.Operation.Name, code).Observe(time.Since(r.Time).Seconds())
+}
+
+// metricsTransport measures the latency of requests made to GCS
+type metricsTransport struct {
+	Transport http.RoundTripper
+}
+
+func (m *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := m.Transport.RoundTrip(req)
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	backendDuration.WithLabelValues("gcs", req.Method, code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// labelPattern matches labels against a glob or a regular expression, deriving the name of a lock from each matching
+// label
+type labelPattern struct {
+	re   *regexp.Regexp
+	glob bool
+}
+
+// newLabelPattern compiles a label pattern. Labels containing a capture group are treated as regular expressions and
+// derive the name of their lock from the first capture group. Other patterns are treated as globs and derive the name
+// of their lock from the text matched by their wildcards.
+func newLabelPattern(pattern string) (*labelPattern, error) {
+	if strings.Contains(pattern, "(") {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+		if re.NumSubexp() == 0 {
+			return nil, errors.New("label pattern must contain a capture group")
+		}
+		return &labelPattern{re: re}, nil
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString("(.+?)")
+		case '?':
+			expr.WriteString("(.)")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+	if re.NumSubexp() == 0 {
+		return nil, errors.New("label pattern must contain a wildcard or a capture group")
+	}
+	return &labelPattern{re: re, glob: true}, nil
+}
+
+// lockName returns the name of the lock requested by a label and whether the label matches the pattern at all.
+// Labels confirming that a lock is held, asking to steal it, requesting a shared hold, waking a waiting PR or setting
+// the priority of a request never match.
+func (lp *labelPattern) lockName(label string) (string, bool) {
+	if i := strings.LastIndex(label, ":"); i >= 0 {
+		switch suffix := label[i+1:]; {
+		case suffix == lockedSuffix, suffix == stealSuffix, suffix == readSuffix, suffix == wakeSuffix, strings.HasPrefix(suffix, prioritySuffix+"-"):
+			return "", false
+		}
+	}
+	matches := lp.re.FindStringSubmatch(label)
+	if matches == nil {
+		return "", false
+	}
+	name := matches[1]
+	if lp.glob {
+		name = strings.Join(matches[1:], "")
+	}
+	return name, name != ""
+}
@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestLabelPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		label   string
+		lock    string
+		matches bool
+	}{
+		{"env:(.*)", "env:preview-3", "preview-3", true},
+		{"env:(.*)", "env:preview-3:locked", "", false},
+		{"env:(.*)", "env:preview-3:read", "", false},
+		{"env:(.*)", "env:preview-3:read:locked", "", false},
+		{"env:(.*)", "env:preview-3:priority-high", "", false},
+		{"env:*", "env:preview-3:steal", "", false},
+		{"env:*", "env:preview-3:read", "", false},
+		{"env:*", "env:preview-3:wake", "", false},
+		{"env:*", "env:preview-3:priority-urgent", "", false},
+		{"env:(.*)", "staging", "", false},
+		{"env:(.*)", "env:", "", false},
+		{"env:(preview-\\d+)", "env:preview-12", "preview-12", true},
+		{"env:(preview-\\d+)", "env:preview-x", "", false},
+		{"env:*", "env:preview-3", "preview-3", true},
+		{"env:*", "xenv:preview-3", "", false},
+		{"preview-?", "preview-7", "7", true},
+		{"preview-?", "preview-10", "", false},
+		{"env.*", "env.qa", "qa", true},
+		{"env.*", "envxqa", "", false},
+	}
+	for _, tt := range tests {
+		lp, err := newLabelPattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("%s: %+v", tt.pattern, err)
+		}
+		lock, matches := lp.lockName(tt.label)
+		if lock != tt.lock || matches != tt.matches {
+			t.Errorf("%s: lockName(%q) = %q, %v; want %q, %v", tt.pattern, tt.label, lock, matches, tt.lock, tt.matches)
+		}
+	}
+}
+
+func TestLabelPatternWithoutCaptureGroup(t *testing.T) {
+	for _, pattern := range []string{"env:(?:preview)", "staging"} {
+		if _, err := newLabelPattern(pattern); err == nil {
+			t.Errorf("%s: expected an error, didn't get one", pattern)
+		}
+	}
+}
+
+func TestLabelPatternsAreOptIn(t *testing.T) {
+	lc := lockConfig{Name: "staging-eu", Label: "staging (eu)", Backend: backendDynamo, Table: "label-mutex", Partition: "label", OnConflict: onConflictWarn}
+	if err := lc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	lm, err := lc.newLabelMutex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lm.pattern != nil || lm.label != "staging (eu)" {
+		t.Errorf("expected '%s' to be treated as a label, got pattern %v", lm.label, lm.pattern)
+	}
+}
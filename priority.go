@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v55/github"
+	"github.com/hashicorp/go-multierror"
+)
+
+var (
+	prioritySuffix = "priority"
+)
+
+const (
+	priorityLow    = "low"
+	priorityNormal = "normal"
+	priorityHigh   = "high"
+	priorityUrgent = "urgent"
+)
+
+// priorityRanks orders the priorities a request for the lock can have
+var priorityRanks = map[string]int{
+	priorityLow:    1,
+	priorityNormal: 2,
+	priorityHigh:   3,
+	priorityUrgent: 4,
+}
+
+// holderRecord is stored alongside a lock when it's obtained so that later requests can be compared to its holder
+type holderRecord struct {
+	Holder   string    `json:"holder"`
+	Priority string    `json:"priority"`
+	Since    time.Time `json:"since"`
+	// Label is the label the holder requested the lock with, empty when it obtained the lock some other way, e.g. as a
+	// workflow run or a holder provided to a workflow_dispatch run
+	Label string `json:"label,omitempty"`
+}
+
+// preemptionRecord is stored alongside a lock while a higher priority request waits out the grace period given to the
+// holder before taking the lock from it
+type preemptionRecord struct {
+	By   string    `json:"by"`
+	From string    `json:"from"`
+	At   time.Time `json:"at"`
+}
+
+// priorityLabelPrefix is the prefix of labels setting the priority of a request for the lock, e.g. staging:priority-high
+func (lm *LabelMutex) priorityLabelPrefix() string {
+	return fmt.Sprintf("%s:%s-", lm.label, prioritySuffix)
+}
+
+// requestPriority is the priority of the holder's request for the lock. A priority label takes precedence over the
+// priorities configured for the holder's author, which only ever raise the lock's default priority. Labels can only
+// set a priority given to someone in priorities.
+func (lm *LabelMutex) requestPriority() (string, error) {
+	for _, label := range lm.holder.labels {
+		if level, ok := strings.CutPrefix(label, lm.priorityLabelPrefix()); ok {
+			if lm.priorityConfigured(level) {
+				return level, nil
+			}
+			lm.logger().Warn("Ignoring priority that isn't listed in priorities", "priority", level)
+		}
+	}
+	priority := lm.defaultPriority()
+	for entry, level := range lm.priorities {
+		if priorityRanks[level] <= priorityRanks[priority] {
+			continue
+		}
+		allowed, err := lm.allowed([]string{entry}, lm.holder.Author())
+		if err != nil {
+			return "", err
+		}
+		if allowed {
+			priority = level
+		}
+	}
+	return priority, nil
+}
+
+// priorityConfigured is true when the level is given to someone in priorities
+func (lm *LabelMutex) priorityConfigured(level string) bool {
+	for _, configured := range lm.priorities {
+		if configured == level {
+			return true
+		}
+	}
+	return false
+}
+
+// mayPrioritize is true when the login may label a request for the lock with the priority. Along with being allowed to
+// request the lock, they must either be allowed to steal it or be given the priority or a higher one in priorities.
+func (lm *LabelMutex) mayPrioritize(login string, level string) (bool, error) {
+	if !lm.priorityConfigured(level) {
+		return false, nil
+	}
+	authorized, err := lm.authorized(login)
+	if err != nil || !authorized {
+		return false, err
+	}
+	allowed, err := lm.allowed(lm.stealAllowed, login)
+	if err != nil || allowed {
+		return allowed, err
+	}
+	for entry, configured := range lm.priorities {
+		if priorityRanks[configured] < priorityRanks[level] {
+			continue
+		}
+		allowed, err = lm.allowed([]string{entry}, login)
+		if err != nil || allowed {
+			return allowed, err
+		}
+	}
+	return false, nil
+}
+
+// refusePriority removes a priority label added by someone who can't set that priority, explaining why on the PR. The
+// request goes ahead with the priority it has without the label.
+func (lm *LabelMutex) refusePriority(login string, label string) error {
+	var resultErr *multierror.Error
+	lm.logger().Info("Requester isn't allowed to set the priority, removing its label", "requester", login, "removed_label", label)
+	lm.holder.withoutLabel(label)
+	err := lm.removeLabel(label)
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	err = lm.comment(lm.holder.Number(), fmt.Sprintf("@%s isn't allowed to set the priority of requests for the `%s` lock to %s, so `%s` was removed. Priorities can be set by users and teams listed in `steal_allowed`, or listed in `priorities` with that priority or a higher one.", login, lm.label, strings.TrimPrefix(label, lm.priorityLabelPrefix()), label))
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	return resultErr.ErrorOrNil()
+}
+
+func (lm *LabelMutex) holderKey() string {
+	return fmt.Sprintf("%s.holder", lm.lock)
+}
+
+func (lm *LabelMutex) preemptionKey() string {
+	return fmt.Sprintf("%s.preemption", lm.lock)
+}
+
+// recordHolder stores the priority the holder obtained the lock with
+func (lm *LabelMutex) recordHolder() error {
+	records, ok := lm.records()
+	if !ok {
+		return nil
+	}
+	priority, err := lm.requestPriority()
+	if err != nil {
+		return err
+	}
+	record := holderRecord{Holder: lm.holder.URL(), Priority: priority, Since: time.Now().UTC()}
+	if lm.holder.Number() != 0 {
+		record.Label = lm.label
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return records.PutRecord(lm.holderKey(), value)
+}
+
+// defaultPriority is the priority of requests for the lock that aren't given a higher one
+func (lm *LabelMutex) defaultPriority() string {
+	if lm.priority == "" {
+		return priorityNormal
+	}
+	return lm.priority
+}
+
+// holderPriority is the priority the current holder of the lock obtained it with. Holders that obtained the lock
+// without recording a priority have the lock's default priority.
+func (lm *LabelMutex) holderPriority(records recordStore, current string) (string, error) {
+	priority := lm.defaultPriority()
+	value, err := records.GetRecord(lm.holderKey())
+	if err != nil || len(value) == 0 {
+		return priority, err
+	}
+	var record holderRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		lm.logger().Warn("Ignoring unreadable holder record", "error", err)
+		return priority, nil
+	}
+	if record.Holder != current || record.Priority == "" {
+		return priority, nil
+	}
+	return record.Priority, nil
+}
+
+// preempt takes the lock from its current holder if the holder's request has a higher priority. With a grace period,
+// the current holder is warned and the lock is only taken once the grace period has passed. Requests with the same
+// priority as the holder wait as usual.
+func (lm *LabelMutex) preempt(current string) (bool, error) {
+	records, ok := lm.records()
+	if !ok {
+		return false, nil
+	}
+	stealer, ok := lm.uriLocker.(StealableLocker)
+	if !ok {
+		return false, nil
+	}
+	lockValue := lm.holder.URL()
+	priority, err := lm.requestPriority()
+	if err != nil {
+		return false, err
+	}
+	currentPriority, err := lm.holderPriority(records, current)
+	if err != nil {
+		return false, err
+	}
+	if priorityRanks[priority] <= priorityRanks[currentPriority] {
+		return false, nil
+	}
+
+	if lm.gracePeriod > 0 {
+		pending, err := lm.pendingPreemption(records, current)
+		if err != nil {
+			return false, err
+		}
+		if pending == nil {
+			return false, lm.schedulePreemption(records, current, priority, currentPriority)
+		}
+		if time.Now().Before(pending.At) {
+			lm.logger().Info("Lock will be taken from its holder", "current_holder", current, "preempt_at", formatTime(pending.At))
+			lm.preemptAt = pending.At
+			return false, nil
+		}
+	}
+
+	lm.logger().Info("Preempting lower priority holder", "priority", priority, "current_holder", current, "current_priority", currentPriority)
+	stolen, err := stealer.Steal(current, lockValue)
+	if err != nil || !stolen {
+		return false, err
+	}
+	var resultErr *multierror.Error
+	lm.locked = true
+	lm.htmlURL = lockValue
+	lm.acquiredAt = time.Now()
+	lm.preemptedFrom = current
+	lm.recordHistory(historyPreempt, lockValue)
+	err = lm.confirmAcquisition(lockValue, current, fmt.Sprintf("%s:%s", lm.label, lockedSuffix))
+	if err != nil {
+		return false, err
+	}
+	if lm.gracePeriod > 0 {
+		err = records.DeleteRecord(lm.preemptionKey())
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	for _, err := range []error{
+		lm.notifyPreempted(current, priority),
+		lm.removeWaiter(),
+		lm.ensureDeployment(),
+	} {
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	return true, resultErr.ErrorOrNil()
+}
+
+// pendingPreemption returns the preemption of the current holder scheduled by the holder's request, if there is one
+func (lm *LabelMutex) pendingPreemption(records recordStore, current string) (*preemptionRecord, error) {
+	value, err := records.GetRecord(lm.preemptionKey())
+	if err != nil || len(value) == 0 {
+		return nil, err
+	}
+	var record preemptionRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		lm.logger().Warn("Ignoring unreadable preemption record", "error", err)
+		return nil, nil
+	}
+	if record.By != lm.holder.URL() || record.From != current {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+// schedulePreemption records that the holder's request will take the lock from its current holder once the grace
+// period has passed, and warns the current holder
+func (lm *LabelMutex) schedulePreemption(records recordStore, current string, priority string, currentPriority string) error {
+	at := time.Now().Add(lm.gracePeriod).UTC()
+	value, err := json.Marshal(preemptionRecord{By: lm.holder.URL(), From: current, At: at})
+	if err != nil {
+		return err
+	}
+	created, err := records.CreateRecord(lm.preemptionKey(), value)
+	if err != nil {
+		return err
+	}
+	if !created {
+		stale, err := lm.stalePreemption(records, current)
+		if err != nil || !stale {
+			// another request is already waiting to preempt the holder
+			return err
+		}
+		err = records.PutRecord(lm.preemptionKey(), value)
+		if err != nil {
+			return err
+		}
+	}
+	lm.logger().Info("Lock will be taken from its holder", "current_holder", current, "preempt_at", formatTime(at))
+	lm.preemptAt = at
+	_, _, number, err := parseIssueURL(current)
+	if err != nil {
+		lm.logger().Warn("Can't warn holder that it will be preempted", "current_holder", current, "error", err)
+		return nil
+	}
+	return lm.comment(number, fmt.Sprintf("%s requested the `%s` lock with %s priority, which is higher than this holder's %s priority. The lock will be taken from this holder after %s unless it's released first.", lm.holder.URL(), lm.label, priority, currentPriority, formatTime(at)))
+}
+
+// stalePreemption is true when the recorded preemption was scheduled for a holder other than the current one, e.g. one
+// that released the lock before its grace period passed
+func (lm *LabelMutex) stalePreemption(records recordStore, current string) (bool, error) {
+	value, err := records.GetRecord(lm.preemptionKey())
+	if err != nil || len(value) == 0 {
+		return len(value) == 0, err
+	}
+	var record preemptionRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		lm.logger().Warn("Replacing unreadable preemption record", "error", err)
+		return true, nil
+	}
+	return record.From != current, nil
+}
+
+// preemptOverdue takes the lock from the current holder for the request that scheduled its preemption once the grace
+// period has passed, rather than waiting for the request to be processed again. Preemptions scheduled by requests that
+// are closed or no longer request the lock are dropped. It returns true when the lock was taken.
+func (lm *LabelMutex) preemptOverdue(current string, open []*github.PullRequest) (bool, error) {
+	records, ok := lm.records()
+	if !ok || lm.gracePeriod <= 0 {
+		return false, nil
+	}
+	value, err := records.GetRecord(lm.preemptionKey())
+	if err != nil || len(value) == 0 {
+		return false, err
+	}
+	var record preemptionRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		lm.logger().Warn("Ignoring unreadable preemption record", "error", err)
+		return false, nil
+	}
+	if record.From != current || time.Now().Before(record.At) {
+		return false, nil
+	}
+	pr := findPullRequest(open, record.By)
+	if pr == nil || !hasLabel(pr, lm.label) {
+		lm.logger().Info("Dropping preemption requested by a holder that no longer requests the lock", "requester", record.By)
+		return false, lm.repair(fmt.Sprintf("dropped the preemption of %s requested by %s, which is closed or isn't labeled '%s'", current, record.By, lm.label), records.DeleteRecord(lm.preemptionKey()))
+	}
+	lm.holder = pullRequestHolder(pr)
+	return lm.preempt(current)
+}
+
+// notifyPreempted strips the labels representing the lock from its previous holder and lets both holders know that
+// the lock was taken
+func (lm *LabelMutex) notifyPreempted(previous string, priority string) error {
+	var resultErr *multierror.Error
+	_, _, number, err := parseIssueURL(previous)
+	if err != nil {
+		lm.logger().Warn("Can't let previous holder know the lock was taken", "previous_holder", previous, "error", err)
+	} else {
+		for _, label := range []string{lm.label, fmt.Sprintf("%s:%s", lm.label, lockedSuffix)} {
+			err = lm.removeLabelFrom(number, label)
+			if err != nil {
+				resultErr = multierror.Append(resultErr, err)
+			}
+		}
+		err = lm.comment(number, fmt.Sprintf("The `%s` lock was taken from this holder by %s, which requested it with %s priority. Add `%s` again to wait for it.", lm.label, lm.holder.URL(), priority, lm.label))
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	err = lm.comment(lm.holder.Number(), fmt.Sprintf("The `%s` lock was taken from %s for this %s priority request.", lm.label, previous, priority))
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	return resultErr.ErrorOrNil()
+}
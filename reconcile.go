@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/go-github/v55/github"
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	modeLock      = "lock"
+	modeReconcile = "reconcile"
+)
+
+// reconcile repairs drift between the lock and the labels on the repository's PRs, e.g. after a run failed between
+// obtaining the lock and labeling the PR or a PR was closed while its unlock job was cancelled. Locks held by PRs that
+// are closed or no longer request them are released, and labels confirming a hold are added to the holder and
+// removed from everyone else.
+func (lm *LabelMutex) reconcile() error {
+	if lm.eventName != "schedule" && lm.eventName != "workflow_dispatch" {
+		lm.logger().Info("Locks can only be reconciled on schedule or workflow_dispatch events, doing nothing")
+		return nil
+	}
+	if lm.pattern != nil {
+		lm.logger().Info("Locks controlled by a label pattern can't be reconciled, doing nothing")
+		return nil
+	}
+	var event struct {
+		Repository *github.Repository `json:"repository"`
+	}
+	err := json.Unmarshal(lm.event, &event)
+	if err != nil {
+		return err
+	}
+	owner := event.Repository.GetOwner().GetLogin()
+	repo := event.Repository.GetName()
+	open, err := lm.openPullRequests(owner, repo)
+	if err != nil {
+		return err
+	}
+
+	var resultErr *multierror.Error
+	holder, err := lm.uriLocker.Read()
+	if err != nil {
+		return err
+	}
+	if holder != "" {
+		err = lm.reconcileHolder(owner, repo, holder, open)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	lockedLabel := fmt.Sprintf("%s:%s", lm.label, lockedSuffix)
+	for _, pr := range open {
+		// the holder has already been reconciled, as has the request that preempted it
+		if pr.GetHTMLURL() == holder || pr.GetHTMLURL() == lm.htmlURL || !hasLabel(pr, lockedLabel) {
+			continue
+		}
+		lm.holder = pullRequestHolder(pr)
+		err = lm.repair(fmt.Sprintf("removed '%s' from %s, which doesn't hold the lock", lockedLabel, pr.GetHTMLURL()), lm.removeLabel(lockedLabel))
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	if sharedLocker, ok := lm.uriLocker.(SharedLocker); ok && lm.shared {
+		err = lm.reconcileReaders(sharedLocker, open)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+
+	lm.holder = nil
+	err = lm.processOther()
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	return resultErr.ErrorOrNil()
+}
+
+// reconcileHolder releases the lock if its holder is closed, no longer requests it or has held it for longer than
+// max_hold, and otherwise makes sure the holder is labeled as such. Like validateHolder, only PRs that requested the
+// lock with its label are released for being closed or unlabeled.
+func (lm *LabelMutex) reconcileHolder(owner string, repo string, holder string, open []*github.PullRequest) error {
+	var resultErr *multierror.Error
+	pr := findPullRequest(open, holder)
+	if pr == nil {
+		_, _, number, err := parsePullRequestURL(holder)
+		if err != nil {
+			lm.logger().Warn("Can't reconcile holder", "current_holder", holder, "error", err)
+			return nil
+		}
+		pr, _, err = lm.pullRequestsClient.Get(lm.context, owner, repo, number)
+		if err != nil {
+			return err
+		}
+	}
+	lm.holder = pullRequestHolder(pr)
+	lockedLabel := fmt.Sprintf("%s:%s", lm.label, lockedSuffix)
+	if lm.holder.State() == "open" && lm.holder.hasLabel(lm.label) {
+		evicted, err := lm.enforceMaxHold(holder)
+		if err != nil {
+			return err
+		}
+		if evicted {
+			err = lm.repair(fmt.Sprintf("released the lock held by %s for longer than %s", holder, lm.maxHold), nil)
+			if err != nil {
+				resultErr = multierror.Append(resultErr, err)
+			}
+			err = lm.notifyWaiters(holder)
+			if err != nil {
+				resultErr = multierror.Append(resultErr, err)
+			}
+			return resultErr.ErrorOrNil()
+		}
+		preempted, err := lm.preemptOverdue(holder, open)
+		if preempted {
+			if err != nil {
+				resultErr = multierror.Append(resultErr, err)
+			}
+			err = lm.repair(fmt.Sprintf("handed the lock held by %s to %s, whose higher priority request's grace period has passed", holder, lm.holder.URL()), nil)
+			if err != nil {
+				resultErr = multierror.Append(resultErr, err)
+			}
+			return resultErr.ErrorOrNil()
+		}
+		if err != nil {
+			return err
+		}
+		lm.holder = pullRequestHolder(pr)
+		if lm.holder.hasLabel(lockedLabel) {
+			return nil
+		}
+		_, _, err = lm.issuesClient.AddLabelsToIssue(lm.context, owner, repo, lm.holder.Number(), []string{lockedLabel})
+		return lm.repair(fmt.Sprintf("added '%s' to %s, which holds the lock", lockedLabel, holder), err)
+	}
+	if !lm.obtainedWithLabel(holder) {
+		lm.logger().Info("Leaving the lock with a holder that didn't request it with its label", "current_holder", holder)
+		return nil
+	}
+
+	_, err := lm.uriLocker.Unlock(holder)
+	if err != nil {
+		return err
+	}
+	reason := "is closed"
+	if lm.holder.State() == "open" {
+		reason = fmt.Sprintf("isn't labeled '%s'", lm.label)
+	}
+	lm.recordHistory(historyRelease, holder)
+	err = lm.repair(fmt.Sprintf("released the lock held by %s, which %s", holder, reason), nil)
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	err = lm.deactivateDeployments()
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	err = lm.notifyWaiters(holder)
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	for _, label := range []string{lm.label, lockedLabel} {
+		if !lm.holder.hasLabel(label) {
+			continue
+		}
+		err = lm.removeLabel(label)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	return resultErr.ErrorOrNil()
+}
+
+// reconcileReaders releases shared holds whose PRs are closed or no longer request them, and removes labels
+// confirming a shared hold from PRs that don't have one
+func (lm *LabelMutex) reconcileReaders(sharedLocker SharedLocker, open []*github.PullRequest) error {
+	var resultErr *multierror.Error
+	readers, err := sharedLocker.Readers()
+	if err != nil {
+		return err
+	}
+	holds := make(map[string]bool)
+	for _, reader := range readers {
+		pr := findPullRequest(open, reader)
+		if pr != nil && hasLabel(pr, lm.sharedLabel()) {
+			holds[reader] = true
+			continue
+		}
+		err = lm.repair(fmt.Sprintf("released the shared hold of %s, which is closed or isn't labeled '%s'", reader, lm.sharedLabel()), sharedLocker.RUnlock(reader))
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	confirmedLabel := fmt.Sprintf("%s:%s", lm.sharedLabel(), lockedSuffix)
+	for _, pr := range open {
+		if holds[pr.GetHTMLURL()] || !hasLabel(pr, confirmedLabel) {
+			continue
+		}
+		lm.holder = pullRequestHolder(pr)
+		err = lm.repair(fmt.Sprintf("removed '%s' from %s, which doesn't share the lock", confirmedLabel, pr.GetHTMLURL()), lm.removeLabel(confirmedLabel))
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	return resultErr.ErrorOrNil()
+}
+
+// repair records a repair made while reconciling unless it failed
+func (lm *LabelMutex) repair(description string, err error) error {
+	if err != nil {
+		return err
+	}
+	lm.logger().Info("Reconciled", "repair", description)
+	lm.repairs = append(lm.repairs, description)
+	return nil
+}
+
+// openPullRequests lists the repository's open PRs
+func (lm *LabelMutex) openPullRequests(owner string, repo string) ([]*github.PullRequest, error) {
+	var open []*github.PullRequest
+	opts := &github.PullRequestListOptions{
+		State:       "open",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		prs, resp, err := lm.pullRequestsClient.List(lm.context, owner, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+		open = append(open, prs...)
+		if resp == nil || resp.NextPage == 0 {
+			return open, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func findPullRequest(prs []*github.PullRequest, htmlURL string) *github.PullRequest {
+	for _, pr := range prs {
+		if pr.GetHTMLURL() == htmlURL {
+			return pr
+		}
+	}
+	return nil
+}
+
+func hasLabel(pr *github.PullRequest, name string) bool {
+	for _, label := range pr.Labels {
+		if label.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
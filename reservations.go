@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	modeReserve   = "reserve"
+	modeUnreserve = "unreserve"
+)
+
+// reservation sets a lock aside for a window of time. While a reservation is active only its holder may obtain the
+// lock, and reservations without a holder freeze the lock entirely.
+type reservation struct {
+	Lock   string    `json:"lock,omitempty" yaml:"lock"`
+	Start  time.Time `json:"start" yaml:"start"`
+	End    time.Time `json:"end" yaml:"end"`
+	Holder string    `json:"holder,omitempty" yaml:"holder"`
+	Reason string    `json:"reason,omitempty" yaml:"reason"`
+}
+
+// calendarFile is the format of the file referenced by the 'calendar' input
+type calendarFile struct {
+	Reservations []reservation `yaml:"reservations"`
+}
+
+// active is true when the reservation covers the provided time
+func (r reservation) active(at time.Time) bool {
+	return !at.Before(r.Start) && at.Before(r.End)
+}
+
+// excludes is true when the reservation keeps the URI from obtaining the lock at the provided time
+func (r reservation) excludes(uri string, at time.Time) bool {
+	return r.active(at) && r.Holder != uri
+}
+
+// describe explains the reservation to someone who was refused because of it
+func (r reservation) describe() string {
+	description := fmt.Sprintf("frozen from %s until %s", formatTime(r.Start), formatTime(r.End))
+	if r.Holder != "" {
+		description = fmt.Sprintf("reserved for %s from %s until %s", r.Holder, formatTime(r.Start), formatTime(r.End))
+	}
+	if r.Reason != "" {
+		description = fmt.Sprintf("%s: %s", description, r.Reason)
+	}
+	return description
+}
+
+func (r reservation) validate() error {
+	if r.Start.IsZero() || r.End.IsZero() {
+		return errors.New("reservations need a start and an end")
+	}
+	if !r.End.After(r.Start) {
+		return fmt.Errorf("reservation starting %s must end after it starts", formatTime(r.Start))
+	}
+	return nil
+}
+
+// loadCalendar reads the reservations declared in a YAML file
+func loadCalendar(path string) ([]reservation, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cf calendarFile
+	err = yaml.Unmarshal(data, &cf)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %w", path, err)
+	}
+	for _, r := range cf.Reservations {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return cf.Reservations, nil
+}
+
+func (lm *LabelMutex) reservationKey(start time.Time) string {
+	// zero padded so that keys sort in the order the reservations start
+	return fmt.Sprintf("%s.reservations.%019d", lm.lock, start.UnixNano())
+}
+
+// listReservations returns the reservations of the lock from its calendar and its store, ordered by when they start
+func (lm *LabelMutex) listReservations() ([]reservation, error) {
+	var reservations []reservation
+	for _, r := range lm.calendar {
+		if r.Lock == "" || r.Lock == lm.lock {
+			reservations = append(reservations, r)
+		}
+	}
+	stored, err := lm.storedReservations()
+	if err != nil {
+		return nil, err
+	}
+	reservations = append(reservations, stored...)
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].Start.Before(reservations[j].Start)
+	})
+	return reservations, nil
+}
+
+// storedReservations returns the reservations of the lock stored alongside it
+func (lm *LabelMutex) storedReservations() ([]reservation, error) {
+	records, ok := lm.records()
+	if !ok {
+		return nil, nil
+	}
+	values, err := records.ListRecords(fmt.Sprintf("%s.reservations.", lm.lock))
+	if err != nil {
+		return nil, err
+	}
+	var reservations []reservation
+	for key, value := range values {
+		var r reservation
+		if err := json.Unmarshal(value, &r); err != nil {
+			lm.logger().Warn("Ignoring unreadable reservation", "key", key, "error", err)
+			continue
+		}
+		reservations = append(reservations, r)
+	}
+	return reservations, nil
+}
+
+// reserved returns the reservation keeping the URI from obtaining the lock right now, if there is one. Stored
+// reservations that can't be read are logged and ignored so that locks without them keep working.
+func (lm *LabelMutex) reserved(uri string) *reservation {
+	reservations := lm.calendar
+	stored, err := lm.storedReservations()
+	if err != nil {
+		lm.logger().Warn("Couldn't read reservations", "error", err)
+	}
+	reservations = append(append([]reservation{}, reservations...), stored...)
+	now := time.Now()
+	for _, r := range reservations {
+		if (r.Lock == "" || r.Lock == lm.lock) && r.excludes(uri, now) {
+			return &r
+		}
+	}
+	return nil
+}
+
+// refuseReserved refuses the holder's request for the lock because of a reservation, explaining why on the holder
+func (lm *LabelMutex) refuseReserved(r *reservation) error {
+	lm.logger().Info("Lock reserved, refusing", "reservation", r.describe())
+	lm.reservation = r
+	lm.recordHistory(historyRefuse, lm.holder.URL())
+	return lm.comment(lm.holder.Number(), fmt.Sprintf("The `%s` lock is %s. Request it again once the reservation ends.", lm.label, r.describe()))
+}
+
+// reserve stores a reservation of the lock, removing reservations that have ended
+func (lm *LabelMutex) reserve() error {
+	records, ok := lm.records()
+	if !ok {
+		return fmt.Errorf("lock '%s' doesn't support reservations", lm.label)
+	}
+	err := lm.pendingReservation.validate()
+	if err != nil {
+		return err
+	}
+	stored, err := lm.storedReservations()
+	if err != nil {
+		return err
+	}
+	for _, r := range stored {
+		if r.End.Before(time.Now()) {
+			err = records.DeleteRecord(lm.reservationKey(r.Start))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	r := lm.pendingReservation
+	r.Lock = lm.lock
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	lm.logger().Info("Reserving", "start", formatTime(r.Start), "end", formatTime(r.End))
+	err = records.PutRecord(lm.reservationKey(r.Start), value)
+	if err != nil {
+		return err
+	}
+	lm.reservations, err = lm.listReservations()
+	return err
+}
+
+// unreserve removes the stored reservation of the lock starting at the pending reservation's start. Reservations
+// declared in a calendar file can only be removed from the file.
+func (lm *LabelMutex) unreserve() error {
+	records, ok := lm.records()
+	if !ok {
+		return fmt.Errorf("lock '%s' doesn't support reservations", lm.label)
+	}
+	if lm.pendingReservation.Start.IsZero() {
+		return errors.New("reservations are removed by their start")
+	}
+	lm.logger().Info("Removing reservation", "start", formatTime(lm.pendingReservation.Start))
+	err := records.DeleteRecord(lm.reservationKey(lm.pendingReservation.Start))
+	if err != nil {
+		return err
+	}
+	lm.reservations, err = lm.listReservations()
+	return err
+}
+
+// reservationsSummary renders a markdown table describing the reservations of locks that were reserved or unreserved
+func reservationsSummary(mutexes []*LabelMutex) string {
+	var b strings.Builder
+	for _, lm := range mutexes {
+		if lm.mode != modeReserve && lm.mode != modeUnreserve {
+			continue
+		}
+		fmt.Fprintf(&b, "### Reservations of `%s`\n\n", lm.lock)
+		b.WriteString("| Start | End | Holder | Reason |\n")
+		b.WriteString("| --- | --- | --- | --- |\n")
+		for _, r := range lm.reservations {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s |\n",
+				formatTime(r.Start),
+				formatTime(r.End),
+				orDash(r.Holder),
+				orDash(r.Reason),
+			)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultGitHubRetries    = 3
+	defaultGitHubRetryDelay = time.Second
+	// maxRetryWait is the longest a request waits before being retried. Requests GitHub asks to wait longer for, e.g.
+	// once the primary rate limit is exhausted, fail rather than holding up the run.
+	maxRetryWait = time.Minute
+)
+
+// retryTransport retries requests to GitHub that fail with a server error or hit a rate limit, backing off
+// exponentially with jitter between attempts unless GitHub says how long to wait
+type retryTransport struct {
+	Transport http.RoundTripper
+	retries   int
+	delay     time.Duration
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		resp, err := rt.Transport.RoundTrip(req)
+		if attempt >= rt.retries || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		wait, retry := rt.retryAfter(req, resp, err, attempt)
+		if !retry {
+			return resp, err
+		}
+		attrs := []any{"method", req.Method, "url", redactURL(req.URL), "attempt", attempt + 1, "wait", wait}
+		if err != nil {
+			attrs = append(attrs, "error", err)
+		} else {
+			attrs = append(attrs, "status", resp.StatusCode)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		slog.WarnContext(ctx, "Retrying GitHub request", attrs...)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+// retryAfter is how long to wait before retrying the request, and whether it should be retried at all. Requests refused
+// by a rate limit weren't processed and are always retried. Connection errors and server errors are only retried for
+// idempotent requests, as GitHub may have processed the request before failing, e.g. creating a comment twice.
+func (rt *retryTransport) retryAfter(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if err != nil {
+		if req.Context().Err() != nil || !idempotent(req) {
+			return 0, false
+		}
+		return rt.backoff(attempt), true
+	}
+	wait, limited := rateLimitWait(resp)
+	switch {
+	case limited:
+	case resp.StatusCode == http.StatusTooManyRequests, secondaryRateLimited(resp):
+		wait = rt.backoff(attempt)
+	case resp.StatusCode == http.StatusInternalServerError, resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable, resp.StatusCode == http.StatusGatewayTimeout:
+		if !idempotent(req) {
+			return 0, false
+		}
+		if wait == 0 {
+			wait = rt.backoff(attempt)
+		}
+	default:
+		return 0, false
+	}
+	return wait, wait <= maxRetryWait
+}
+
+// idempotent is true for requests that can safely be repeated. Adding labels is a POST, but adding a label an issue
+// already has does nothing.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		return strings.HasSuffix(req.URL.Path, "/labels")
+	}
+	return false
+}
+
+// secondaryRateLimited is true for a 403 whose body says a secondary rate limit was exceeded, which GitHub doesn't
+// always accompany with a Retry-After header. The body is restored for the caller to read.
+func secondaryRateLimited(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusForbidden || resp.Body == nil {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return err == nil && strings.Contains(strings.ToLower(string(body)), "secondary rate limit")
+}
+
+// rateLimitWait reads how long GitHub asked for requests to be held off from the Retry-After and X-RateLimit headers
+// of a response, and whether the response was refused by a rate limit. Secondary rate limits are reported as a 403
+// or 429 with a Retry-After header; an exhausted primary rate limit by X-RateLimit-Remaining reaching zero.
+func rateLimitWait(resp *http.Response) (time.Duration, bool) {
+	limited := resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second, limited
+		}
+		if at, err := http.ParseTime(retryAfter); err == nil {
+			return time.Until(at), limited
+		}
+	}
+	if limited && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return time.Until(time.Unix(reset, 0)), true
+		}
+	}
+	return 0, false
+}
+
+// backoff doubles the delay with each attempt up to maxRetryWait, waiting a random duration between half the delay and
+// the delay so that concurrent runs don't retry in lockstep
+func (rt *retryTransport) backoff(attempt int) time.Duration {
+	delay := rt.delay
+	for i := 0; i < attempt && delay < maxRetryWait; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryWait {
+		delay = maxRetryWait
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v55/github"
+)
+
+func TestRetryTransport(t *testing.T) {
+	rateLimited := func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusForbidden)
+	}
+	exhausted := func(w http.ResponseWriter) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		w.WriteHeader(http.StatusForbidden)
+	}
+	secondaryRateLimited := func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"message": "You have exceeded a secondary rate limit. Please wait a few minutes before you try again."}`))
+	}
+	status := func(code int) func(http.ResponseWriter) {
+		return func(w http.ResponseWriter) { w.WriteHeader(code) }
+	}
+	tests := []struct {
+		name      string
+		responses []func(http.ResponseWriter)
+		comment   bool
+		retries   int
+		err       bool
+		attempts  int
+	}{
+		{"succeeds", nil, false, 3, false, 1},
+		{"retries server errors", []func(http.ResponseWriter){status(http.StatusBadGateway), status(http.StatusServiceUnavailable)}, false, 3, false, 3},
+		{"retries secondary rate limits", []func(http.ResponseWriter){rateLimited, status(http.StatusTooManyRequests), secondaryRateLimited}, false, 3, false, 4},
+		{"gives up after retries", []func(http.ResponseWriter){status(http.StatusBadGateway), status(http.StatusBadGateway), status(http.StatusBadGateway)}, false, 2, true, 3},
+		{"doesn't retry when disabled", []func(http.ResponseWriter){status(http.StatusBadGateway)}, false, 0, true, 1},
+		{"doesn't retry client errors", []func(http.ResponseWriter){status(http.StatusForbidden)}, false, 3, true, 1},
+		{"doesn't wait for the primary rate limit to reset", []func(http.ResponseWriter){exhausted}, false, 3, true, 1},
+		{"doesn't retry server errors creating comments", []func(http.ResponseWriter){status(http.StatusBadGateway)}, true, 3, true, 1},
+		{"retries rate limited comments", []func(http.ResponseWriter){secondaryRateLimited}, true, 3, false, 2},
+	}
+	for _, tt := range tests {
+		var attempts int
+		var bodies []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			attempts++
+			if attempts <= len(tt.responses) {
+				tt.responses[attempts-1](w)
+				return
+			}
+			if tt.comment {
+				w.Write([]byte(`{"body": "locked"}`))
+				return
+			}
+			w.Write([]byte(`[{"name": "staging:locked"}]`))
+		}))
+
+		client := github.NewClient(&http.Client{Transport: &retryTransport{Transport: http.DefaultTransport, retries: tt.retries, delay: time.Millisecond}})
+		client.BaseURL, _ = url.Parse(server.URL + "/")
+		var err error
+		if tt.comment {
+			_, _, err = client.Issues.CreateComment(context.Background(), "urcomputeringpal", "label-mutex", 1, &github.IssueComment{Body: github.String("locked")})
+		} else {
+			_, _, err = client.Issues.AddLabelsToIssue(context.Background(), "urcomputeringpal", "label-mutex", 1, []string{"staging:locked"})
+		}
+		server.Close()
+
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error: got %v, want error %v", tt.name, err, tt.err)
+		}
+		if attempts != tt.attempts {
+			t.Errorf("%s: attempts: got %d, want %d", tt.name, attempts, tt.attempts)
+		}
+		for i, body := range bodies {
+			if body != bodies[0] || body == "" {
+				t.Errorf("%s: attempt %d sent body %q, want %q", tt.name, i+1, body, bodies[0])
+			}
+		}
+	}
+}
+
+func TestRetryTransportStopsWhenCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = (&retryTransport{Transport: http.DefaultTransport, retries: 3, delay: time.Millisecond}).RoundTrip(req)
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("waited %v after the request was canceled", elapsed)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	rt := &retryTransport{delay: time.Second}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		for i := 0; i < 20; i++ {
+			wait := rt.backoff(attempt)
+			if wait < max/2 || wait > max {
+				t.Errorf("attempt %d: got %v, want between %v and %v", attempt, wait, max/2, max)
+			}
+		}
+	}
+	if wait := rt.backoff(20); wait > maxRetryWait {
+		t.Errorf("got %v, want at most %v", wait, maxRetryWait)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/google/go-github/v55/github"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+const (
+	modeServer    = "server"
+	defaultListen = ":8080"
+)
+
+// webhookHandler processes the GitHub webhooks delivered to the server for each of its locks
+type webhookHandler struct {
+	config *config
+	client *github.Client
+	locks  []lockConfig
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, err := github.ValidatePayload(r, []byte(h.config.webhookSecret))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	eventName := github.WebHookType(r)
+	slog.Info("Processing delivery", "event", eventName, "delivery", github.DeliveryID(r))
+	// deliveries aren't interrupted when GitHub stops waiting for a response, but are still traced beneath the request
+	mutexes, err := h.config.processEvent(context.WithoutCancel(r.Context()), h.client, h.locks, eventName, payload)
+	if err != nil {
+		slog.Error("Couldn't process delivery", "event", eventName, "delivery", github.DeliveryID(r), "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	output, err := outputs(mutexes, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(output)
+}
+
+// serve processes GitHub webhooks delivered to /webhook and serves metrics describing the locks on /metrics until the
+// server stops
+func (c *config) serve(ctx context.Context, client *github.Client, locks []lockConfig) error {
+	mux := http.NewServeMux()
+	mux.Handle("/webhook", otelhttp.NewHandler(&webhookHandler{config: c, client: client, locks: locks}, "webhook"))
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Addr:        c.listen,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	slog.Info("Listening for webhooks", "address", c.listen)
+	return server.ListenAndServe()
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+var (
+	readSuffix = "read"
+)
+
+// sharedLocker adds shared holds to a lock. Readers are stored as records alongside the lock while the lock itself acts
+// as the writer slot, so a URI can only obtain an exclusive hold once every reader has released theirs and readers
+// are refused while a URI holds the lock exclusively. Like the lock, readers expire after ttl unless it is zero.
+type sharedLocker struct {
+	URILocker
+	records recordStore
+	name    string
+	ttl     time.Duration
+}
+
+// readerRecord is stored for each reader of a shared lock
+type readerRecord struct {
+	HTMLURL   string    `json:"html_url"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+func newSharedLocker(name string, locker URILocker, records recordStore, ttl time.Duration) *sharedLocker {
+	return &sharedLocker{
+		URILocker: locker,
+		records:   records,
+		name:      name,
+		ttl:       ttl,
+	}
+}
+
+func (sl *sharedLocker) traceWith(ctx context.Context) {
+	traceLocker(sl.URILocker, ctx)
+}
+
+func (sl *sharedLocker) readerKey(uri string) string {
+	return fmt.Sprintf("%s.readers.%x", sl.name, sha1.Sum([]byte(uri)))
+}
+
+// Lock obtains an exclusive hold unless the lock is held by readers other than the URI
+func (sl *sharedLocker) Lock(uri string) (bool, string, error) {
+	reader, err := sl.otherReader(uri)
+	if err != nil || reader != "" {
+		if reader != "" {
+			slog.Info("Lock shared, refusing exclusive hold", "lock", sl.name, "reader", reader)
+		}
+		return false, reader, err
+	}
+	success, existing, err := sl.URILocker.Lock(uri)
+	if err != nil || !success {
+		return success, existing, err
+	}
+	// a reader may have joined after the first check
+	reader, err = sl.otherReader(uri)
+	if err != nil || reader != "" {
+		_, unlockErr := sl.URILocker.Unlock(uri)
+		if err == nil {
+			err = unlockErr
+		}
+		return false, reader, err
+	}
+	return success, existing, nil
+}
+
+// RLock adds the URI to the lock's readers unless another URI holds the lock exclusively
+func (sl *sharedLocker) RLock(uri string) (bool, string, error) {
+	writer, err := sl.URILocker.Read()
+	if err != nil {
+		return false, "", err
+	}
+	if writer != "" && writer != uri {
+		return false, writer, nil
+	}
+	value, err := sl.readerRecord(uri)
+	if err != nil {
+		return false, "", err
+	}
+	created, err := sl.records.CreateRecord(sl.readerKey(uri), value)
+	if err != nil {
+		return false, "", err
+	}
+	// renew the reader's hold, obtaining it again if it had expired
+	if !created && sl.ttl > 0 {
+		existing, err := sl.records.GetRecord(sl.readerKey(uri))
+		if err != nil {
+			return false, "", err
+		}
+		created = existing == nil || parseReaderRecord(existing).expired()
+		err = sl.records.PutRecord(sl.readerKey(uri), value)
+		if err != nil {
+			return false, "", err
+		}
+	}
+	// a writer may have obtained the lock after the first check
+	writer, err = sl.URILocker.Read()
+	if err != nil {
+		return false, "", err
+	}
+	if writer != "" && writer != uri {
+		return false, writer, sl.records.DeleteRecord(sl.readerKey(uri))
+	}
+	return created, uri, nil
+}
+
+// FencingToken returns the token issued when the URI obtained an exclusive hold. Shared holds aren't issued tokens.
+func (sl *sharedLocker) FencingToken(uri string) (int64, error) {
+	if fenced, ok := sl.URILocker.(FencedLocker); ok {
+		return fenced.FencingToken(uri)
+	}
+	return 0, nil
+}
+
+func (sl *sharedLocker) RUnlock(uri string) error {
+	return sl.records.DeleteRecord(sl.readerKey(uri))
+}
+
+// Readers returns the URIs sharing the lock, clearing readers whose hold expired
+func (sl *sharedLocker) Readers() ([]string, error) {
+	records, err := sl.records.ListRecords(fmt.Sprintf("%s.readers.", sl.name))
+	if err != nil {
+		return nil, err
+	}
+	var readers []string
+	for key, value := range records {
+		record := parseReaderRecord(value)
+		if record.expired() {
+			slog.Info("Shared hold expired", "lock", sl.name, "reader", record.HTMLURL)
+			if err := sl.records.DeleteRecord(key); err != nil {
+				slog.Warn("Couldn't clear expired shared hold", "lock", sl.name, "reader", record.HTMLURL, "error", err)
+			}
+			continue
+		}
+		readers = append(readers, record.HTMLURL)
+	}
+	sort.Strings(readers)
+	return readers, nil
+}
+
+func (sl *sharedLocker) readerRecord(uri string) ([]byte, error) {
+	record := readerRecord{HTMLURL: uri}
+	if sl.ttl > 0 {
+		record.ExpiresAt = time.Now().Add(sl.ttl).UTC()
+	}
+	return json.Marshal(record)
+}
+
+// parseReaderRecord reads a reader's record. Readers recorded before holds expired were stored as the bare URI.
+func parseReaderRecord(value []byte) readerRecord {
+	var record readerRecord
+	if err := json.Unmarshal(value, &record); err != nil || record.HTMLURL == "" {
+		return readerRecord{HTMLURL: string(value)}
+	}
+	return record
+}
+
+func (r readerRecord) expired() bool {
+	return !r.ExpiresAt.IsZero() && time.Now().After(r.ExpiresAt)
+}
+
+// Steal takes an exclusive hold from its holder if the underlying lock can be stolen
+func (sl *sharedLocker) Steal(previous string, uri string) (bool, error) {
+	stealer, ok := sl.URILocker.(StealableLocker)
+	if !ok {
+		return false, fmt.Errorf("lock '%s' can't be stolen", sl.name)
+	}
+	return stealer.Steal(previous, uri)
+}
+
+// Expired returns the holder of an exclusive hold that expired, if the underlying lock expires
+func (sl *sharedLocker) Expired() string {
+	if expiring, ok := sl.URILocker.(ExpiringLocker); ok {
+		return expiring.Expired()
+	}
+	return ""
+}
+
+// CreateRecord, PutRecord, GetRecord, DeleteRecord and ListRecords store records alongside the lock, so that waiters,
+// holders and history work the same for shared locks
+
+func (sl *sharedLocker) CreateRecord(key string, value []byte) (bool, error) {
+	return sl.records.CreateRecord(key, value)
+}
+
+func (sl *sharedLocker) PutRecord(key string, value []byte) error {
+	return sl.records.PutRecord(key, value)
+}
+
+func (sl *sharedLocker) GetRecord(key string) ([]byte, error) {
+	return sl.records.GetRecord(key)
+}
+
+func (sl *sharedLocker) DeleteRecord(key string) error {
+	return sl.records.DeleteRecord(key)
+}
+
+func (sl *sharedLocker) ListRecords(prefix string) (map[string][]byte, error) {
+	return sl.records.ListRecords(prefix)
+}
+
+// otherReader returns a reader other than the URI, if there is one
+func (sl *sharedLocker) otherReader(uri string) (string, error) {
+	readers, err := sl.Readers()
+	if err != nil {
+		return "", err
+	}
+	for _, reader := range readers {
+		if reader != uri {
+			return reader, nil
+		}
+	}
+	return "", nil
+}
+
+// sharedLabel is the label used to request a shared hold on the lock
+func (lm *LabelMutex) sharedLabel() string {
+	return fmt.Sprintf("%s:%s", lm.label, readSuffix)
+}
+
+// obtainShared adds the PR to the lock's readers and confirms it with a label
+func (lm *LabelMutex) obtainShared(sharedLocker SharedLocker, confirmed bool) error {
+	lockValue := lm.holder.URL()
+	lm.logger().Info("Shared hold requested, sharing")
+	lm.requested = true
+	if !confirmed {
+		reservation := lm.reserved(lockValue)
+		if reservation != nil {
+			return lm.refuseReserved(reservation)
+		}
+	}
+	success, existingValue, err := sharedLocker.RLock(lockValue)
+	if err != nil {
+		return err
+	}
+	if existingValue != lockValue {
+		lm.logger().Info("Lock claimed exclusively by another holder", "current_holder", existingValue)
+		lm.locked = true
+		lm.htmlURL = existingValue
+		lm.recordHistory(historyRefuse, lockValue)
+		return lm.addWaiter()
+	}
+	if success {
+		lm.logger().Info("Shared hold obtained")
+		lm.acquiredAt = time.Now()
+		lm.recordHistory(historyAcquire, lockValue)
+		err = lm.removeWaiter()
+		if err != nil {
+			return err
+		}
+	}
+	lm.locked = true
+	lm.sharedHold = true
+	lm.htmlURL = lockValue
+	lm.readers, err = sharedLocker.Readers()
+	if err != nil {
+		return err
+	}
+	if confirmed {
+		return nil
+	}
+	err = lm.addLabels(fmt.Sprintf("%s:%s", lm.sharedLabel(), lockedSuffix))
+	if err != nil && success {
+		return lm.rollbackSharedHold(sharedLocker, lockValue, err)
+	}
+	return err
+}
+
+// releaseShared removes the PR from the lock's readers along with the labels requesting and confirming its hold
+func (lm *LabelMutex) releaseShared(sharedLocker SharedLocker) error {
+	var resultErr *multierror.Error
+	lm.logger().Info("Releasing shared hold")
+	err := sharedLocker.RUnlock(lm.holder.URL())
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	} else {
+		lm.recordHistory(historyRelease, lm.holder.URL())
+	}
+	err = lm.removeWaiter()
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	// a PR waiting for an exclusive hold can obtain it once the last reader is gone
+	readers, err := sharedLocker.Readers()
+	if err == nil && len(readers) == 0 {
+		err = lm.notifyWaiters(lm.holder.URL())
+	}
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	for _, label := range []string{lm.sharedLabel(), fmt.Sprintf("%s:%s", lm.sharedLabel(), lockedSuffix)} {
+		err = lm.removeLabel(label)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	return resultErr.ErrorOrNil()
+}
+
+// readShared reports the holder of the lock along with its readers. The lock is considered locked if it is held
+// exclusively or shared by any reader.
+func (lm *LabelMutex) readShared(sharedLocker SharedLocker) error {
+	writer, err := sharedLocker.Read()
+	if err != nil {
+		return err
+	}
+	writer, err = lm.validateHolder(writer)
+	if err != nil {
+		return err
+	}
+	lm.readers, err = sharedLocker.Readers()
+	if err != nil {
+		return err
+	}
+	lm.htmlURL = writer
+	lm.locked = writer != "" || len(lm.readers) > 0
+	lm.unlocked = !lm.locked
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// slotLocker allows up to len(slots) URIs to hold a lock at the same time by claiming one of several underlying locks.
+// Fencing tokens are issued from a single counter for the lock so that they increase whichever slot is obtained.
+type slotLocker struct {
+	name  string
+	slots []URILocker
+}
+
+// slotName returns the name of the underlying lock backing the provided slot. The first slot uses the name of the lock
+// itself so that a lock can go from one slot to several without being released.
+func slotName(name string, slot int) string {
+	if slot == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s-slot-%d", name, slot)
+}
+
+func (sl *slotLocker) traceWith(ctx context.Context) {
+	for _, slot := range sl.slots {
+		traceLocker(slot, ctx)
+	}
+}
+
+// Lock claims a free slot unless the URI already holds one. When every slot is taken the holder of the first slot is
+// returned.
+func (sl *slotLocker) Lock(uri string) (bool, string, error) {
+	holders, err := sl.holders()
+	if err != nil {
+		return false, "", err
+	}
+	for i, holder := range holders {
+		if holder == uri {
+			return sl.slots[i].Lock(uri)
+		}
+	}
+	var firstHolder string
+	for i, slot := range sl.slots {
+		if holders[i] != "" {
+			continue
+		}
+		success, existing, err := slot.Lock(uri)
+		if err != nil {
+			return false, "", err
+		}
+		if success {
+			err = issueToken(slot, sl.name, sl.tokenKey(i), uri)
+			if err != nil {
+				_, unlockErr := slot.Unlock(uri)
+				return false, "", multierror.Append(err, unlockErr).ErrorOrNil()
+			}
+		}
+		if success || existing == uri {
+			slog.Info("Obtained slot", "slot", i)
+			return success, existing, nil
+		}
+		if firstHolder == "" {
+			firstHolder = existing
+		}
+	}
+	if firstHolder == "" {
+		firstHolder = holders[0]
+	}
+	return false, firstHolder, nil
+}
+
+// Unlock releases the slot held by the URI
+func (sl *slotLocker) Unlock(uri string) (string, error) {
+	holders, err := sl.holders()
+	if err != nil {
+		return "", err
+	}
+	var firstHolder string
+	for i, holder := range holders {
+		if holder == uri {
+			return sl.slots[i].Unlock(uri)
+		}
+		if firstHolder == "" {
+			firstHolder = holder
+		}
+	}
+	if firstHolder == "" {
+		return "", errors.New("couldn't unlock, no slots are held")
+	}
+	return firstHolder, fmt.Errorf("couldn't unlock with provided value of %s, slots currently held by others", uri)
+}
+
+// Read returns an empty string if any slot is free, or the holder of the first slot if they're all taken
+func (sl *slotLocker) Read() (string, error) {
+	holders, err := sl.holders()
+	if err != nil {
+		return "", err
+	}
+	for _, holder := range holders {
+		if holder == "" {
+			return "", nil
+		}
+	}
+	return holders[0], nil
+}
+
+// FencingToken returns the token issued when the URI obtained its slot
+func (sl *slotLocker) FencingToken(uri string) (int64, error) {
+	holders, err := sl.holders()
+	if err != nil {
+		return 0, err
+	}
+	for i, holder := range holders {
+		if holder == uri {
+			return issuedTokenOf(sl.slots[i], sl.tokenKey(i), uri)
+		}
+	}
+	return 0, nil
+}
+
+// tokenKey is the key of the record holding the token issued to the holder of the slot
+func (sl *slotLocker) tokenKey(slot int) string {
+	return fmt.Sprintf("%s.token", slotName(sl.name, slot))
+}
+
+// Expired returns the holder of a slot that expired, if any
+func (sl *slotLocker) Expired() string {
+	for _, slot := range sl.slots {
+		if expiring, ok := slot.(ExpiringLocker); ok {
+			if expired := expiring.Expired(); expired != "" {
+				return expired
+			}
+		}
+	}
+	return ""
+}
+
+func (sl *slotLocker) Provider() string {
+	return sl.slots[0].Provider()
+}
+
+func (sl *slotLocker) holders() ([]string, error) {
+	holders := make([]string, len(sl.slots))
+	for i, slot := range sl.slots {
+		holder, err := slot.Read()
+		if err != nil {
+			return nil, err
+		}
+		holders[i] = holder
+	}
+	return holders, nil
+}
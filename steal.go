@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/go-github/v55/github"
+	"github.com/hashicorp/go-multierror"
+)
+
+var (
+	stealSuffix = "steal"
+)
+
+// stealRecord is stored alongside a lock each time it's stolen
+type stealRecord struct {
+	By   string    `json:"by"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// stealLabel is the label used to take the lock from its current holder
+func (lm *LabelMutex) stealLabel() string {
+	return fmt.Sprintf("%s:%s", lm.label, stealSuffix)
+}
+
+// steal takes the lock from its current holder on behalf of the PR if the sender of the event is allowed to do so. The
+// request is always consumed by removing the label used to make it.
+func (lm *LabelMutex) steal(sender string) error {
+	var resultErr *multierror.Error
+	lockValue := lm.holder.URL()
+	lm.requested = true
+	err := lm.removeLabel(lm.stealLabel())
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+
+	allowed, err := lm.allowed(lm.stealAllowed, sender)
+	if err != nil {
+		return multierror.Append(resultErr, err).ErrorOrNil()
+	}
+	if !allowed {
+		lm.logger().Info("Sender isn't allowed to steal the lock", "sender", sender)
+		err = lm.comment(lm.holder.Number(), fmt.Sprintf("@%s isn't allowed to steal the `%s` lock. Ask someone listed in `steal_allowed` to steal it instead.", sender, lm.label))
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+		err = lm.processOther()
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+		return resultErr.ErrorOrNil()
+	}
+
+	reservation := lm.reserved(lockValue)
+	if reservation != nil {
+		return multierror.Append(resultErr, lm.refuseReserved(reservation)).ErrorOrNil()
+	}
+
+	stealer, ok := lm.uriLocker.(StealableLocker)
+	if !ok {
+		return multierror.Append(resultErr, fmt.Errorf("lock '%s' can't be stolen", lm.label)).ErrorOrNil()
+	}
+	previous, err := stealer.Read()
+	if err != nil {
+		return multierror.Append(resultErr, err).ErrorOrNil()
+	}
+	obtained := true
+	if previous == "" || previous == lockValue {
+		lm.logger().Info("Lock isn't held by anyone else, locking")
+		success, existingValue, err := stealer.Lock(lockValue)
+		if err != nil {
+			return multierror.Append(resultErr, err).ErrorOrNil()
+		}
+		if !success && existingValue != lockValue {
+			lm.logger().Info("Lock claimed by another holder in the meantime", "current_holder", existingValue)
+			lm.locked = true
+			lm.htmlURL = existingValue
+			return resultErr.ErrorOrNil()
+		}
+		obtained = success
+		previous = ""
+	} else {
+		lm.logger().Info("Stealing lock", "sender", sender, "previous_holder", previous)
+		stolen, err := stealer.Steal(previous, lockValue)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+		if !stolen {
+			lm.logger().Info("Lock changed hands while stealing it")
+			err = lm.processOther()
+			if err != nil {
+				resultErr = multierror.Append(resultErr, err)
+			}
+			return resultErr.ErrorOrNil()
+		}
+	}
+
+	lm.locked = true
+	lm.htmlURL = lockValue
+	lm.acquiredAt = time.Now()
+	lm.stolenFrom = previous
+	lm.stolenBy = sender
+	if previous != "" {
+		lm.recordHistory(historySteal, lockValue)
+	} else {
+		lm.recordHistory(historyAcquire, lockValue)
+	}
+	labels := []string{lm.label, fmt.Sprintf("%s:%s", lm.label, lockedSuffix)}
+	if obtained {
+		err = lm.confirmAcquisition(lockValue, previous, labels...)
+		if err != nil {
+			return multierror.Append(resultErr, err).ErrorOrNil()
+		}
+	} else {
+		err = lm.addLabels(labels...)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	if previous != "" {
+		err = lm.recordSteal(previous, sender)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	err = lm.ensureDeployment()
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	return resultErr.ErrorOrNil()
+}
+
+// recordSteal records who stole the lock, strips the labels representing the lock from the previous holder and lets
+// both PRs know what happened
+func (lm *LabelMutex) recordSteal(previous string, sender string) error {
+	var resultErr *multierror.Error
+	lockValue := lm.holder.URL()
+	if records, ok := lm.uriLocker.(recordStore); ok {
+		record, err := json.Marshal(stealRecord{By: sender, From: previous, To: lockValue, At: lm.acquiredAt.UTC()})
+		if err == nil {
+			err = records.PutRecord(fmt.Sprintf("%s.stolen", lm.lock), record)
+		}
+		if err != nil {
+			resultErr = multierror.Append(resultErr, fmt.Errorf("couldn't record steal: %w", err))
+		}
+	}
+
+	_, _, number, err := parseIssueURL(previous)
+	if err != nil {
+		lm.logger().Warn("Can't let previous holder know the lock was stolen", "previous_holder", previous, "error", err)
+	} else {
+		for _, label := range []string{lm.label, fmt.Sprintf("%s:%s", lm.label, lockedSuffix)} {
+			err = lm.removeLabelFrom(number, label)
+			if err != nil {
+				resultErr = multierror.Append(resultErr, err)
+			}
+		}
+		err = lm.comment(number, fmt.Sprintf("@%s stole the `%s` lock from this PR for %s.", sender, lm.label, lockValue))
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+	}
+	err = lm.comment(lm.holder.Number(), fmt.Sprintf("@%s stole the `%s` lock for this PR from %s.", sender, lm.label, previous))
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err)
+	}
+	return resultErr.ErrorOrNil()
+}
+
+// comment adds a comment to a PR or issue in the repository of the holder, doing nothing for holders that can't be
+// commented on
+func (lm *LabelMutex) comment(number int, body string) error {
+	if number == 0 {
+		return nil
+	}
+	_, _, err := lm.issuesClient.CreateComment(lm.context, lm.holder.Owner(), lm.holder.Repo(), number, &github.IssueComment{Body: github.String(body)})
+	return err
+}
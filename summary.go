@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sethvargo/go-githubactions"
+)
+
+// state describes the lock as seen by the current run
+func (lm *LabelMutex) state() string {
+	switch {
+	case lm.reservation != nil:
+		return "reserved"
+	case lm.locked && lm.refused():
+		return "held by another PR"
+	case lm.sharedHold:
+		return "shared"
+	case lm.locked:
+		return "locked"
+	case lm.unlocked:
+		return "unlocked"
+	}
+	return "unknown"
+}
+
+// refused is true when the current PR requested the lock but someone else holds it
+func (lm *LabelMutex) refused() bool {
+	return lm.requested && lm.locked && lm.holder != nil && lm.htmlURL != lm.holder.URL()
+}
+
+// refusal describes why the lock couldn't be obtained for the current PR, or is empty when it wasn't refused
+func (lm *LabelMutex) refusal() string {
+	switch {
+	case lm.reservation != nil:
+		return fmt.Sprintf("Couldn't obtain a lock on %s, which is %s", lm.lock, lm.reservation.describe())
+	case lm.refused():
+		return fmt.Sprintf("Couldn't obtain a lock on %s. Someone may already be using it: %s", lm.lock, lm.htmlURL)
+	}
+	return ""
+}
+
+// queue lists the other PRs waiting on the lock
+func (lm *LabelMutex) queue() []string {
+	var queue []string
+	for _, w := range lm.waiters {
+		if lm.holder != nil && w.HTMLURL == lm.holder.URL() {
+			continue
+		}
+		queue = append(queue, w.HTMLURL)
+	}
+	return queue
+}
+
+// summary renders a markdown table describing the state of each lock
+func summary(mutexes []*LabelMutex) string {
+	var b strings.Builder
+	b.WriteString("### label-mutex\n\n")
+	b.WriteString("| Lock | Holder | State | Queue | Acquired | Checked |\n")
+	b.WriteString("| --- | --- | --- | --- | --- | --- |\n")
+	for _, lm := range mutexes {
+		fmt.Fprintf(&b, "| `%s` | %s | %s | %s | %s | %s |\n",
+			lm.lock,
+			orDash(lm.htmlURL),
+			lm.state(),
+			orDash(strings.Join(lm.queue(), "<br>")),
+			orDash(formatTime(lm.acquiredAt)),
+			orDash(formatTime(lm.checkedAt)),
+		)
+	}
+	b.WriteString(historySummary(mutexes))
+	b.WriteString(reservationsSummary(mutexes))
+	return b.String()
+}
+
+// report writes a job summary for the provided locks and annotates the run with the outcome of each lock request
+func report(action *githubactions.Action, mutexes []*LabelMutex) {
+	if action.Getenv("GITHUB_STEP_SUMMARY") != "" {
+		action.AddStepSummary(summary(mutexes))
+	}
+	for _, lm := range mutexes {
+		for _, repair := range lm.repairs {
+			action.Noticef("Reconciled %s: %s", lm.lock, repair)
+		}
+		if lm.notified > 0 {
+			action.Noticef("Let %d PRs waiting on %s know that it's free", lm.notified, lm.lock)
+		}
+		if !lm.preemptAt.IsZero() {
+			action.Noticef("Lock on %s will be taken from %s at %s", lm.lock, lm.htmlURL, formatTime(lm.preemptAt))
+		}
+		if lm.evictedFrom != "" {
+			action.Noticef("Lock on %s taken from %s, which held it for longer than %s", lm.lock, lm.evictedFrom, lm.maxHold)
+		}
+		refusal := lm.refusal()
+		switch {
+		case refusal != "" && lm.onConflict == onConflictFail:
+			action.Errorf("%s", refusal)
+		case refusal != "" && lm.onConflict == onConflictIgnore:
+		case refusal != "":
+			action.Warningf("%s", refusal)
+		case lm.unauthorized != "":
+			action.Warningf("%s isn't allowed to request a lock on %s", lm.unauthorized, lm.lock)
+		case lm.preemptedFrom != "":
+			action.Noticef("Lock on %s taken from %s by a higher priority request", lm.lock, lm.preemptedFrom)
+		case lm.stolenFrom != "":
+			action.Noticef("Lock on %s stolen from %s by %s", lm.lock, lm.stolenFrom, lm.stolenBy)
+		case lm.requested && lm.locked:
+			action.Noticef("Lock on %s held by %s", lm.lock, lm.htmlURL)
+		case lm.releasedFrom != "":
+			action.Noticef("Lock on %s released from %s, which is closed or no longer requests it", lm.lock, lm.releasedFrom)
+		case lm.released:
+			action.Noticef("Lock on %s released", lm.lock)
+		}
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
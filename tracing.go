@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/urcomputeringpal/label-mutex")
+
+// setupTracing exports spans over OTLP when an OTLP endpoint is configured in the environment, returning a function
+// that flushes them. W3C trace context is propagated either way.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.NewSchemaless(attribute.String("service.name", "label-mutex")), resource.Environment())
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// contextFromEnvironment continues the trace described by the TRACEPARENT and TRACESTATE environment variables, e.g.
+// when a workflow passes the trace context of the job running the action
+func contextFromEnvironment(ctx context.Context) context.Context {
+	carrier := propagation.MapCarrier{
+		"traceparent": os.Getenv("TRACEPARENT"),
+		"tracestate":  os.Getenv("TRACESTATE"),
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// tracedTransport starts a span for each request made to the named service
+func tracedTransport(service string, transport http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(transport, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return service + " " + r.Method
+	}))
+}
+
+// endSpan records the error the span ended with, if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedLocker is implemented by lockers that trace their methods beneath the span of the event being processed
+type tracedLocker interface {
+	traceWith(ctx context.Context)
+}
+
+// traceLocker has the locker trace its methods beneath the context's span if it can
+func traceLocker(locker URILocker, ctx context.Context) {
+	if traced, ok := locker.(tracedLocker); ok {
+		traced.traceWith(ctx)
+	}
+}
+
+// lockerTracer starts a span for each request a locker makes to its backend
+type lockerTracer struct {
+	provider string
+	lock     string
+	ctx      context.Context
+}
+
+func (lt *lockerTracer) traceWith(ctx context.Context) {
+	lt.ctx = ctx
+}
+
+func (lt *lockerTracer) startSpan(method string) (context.Context, trace.Span) {
+	ctx := lt.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return tracer.Start(ctx, lt.provider+"."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("lock.provider", lt.provider), attribute.String("lock.name", lt.lock)),
+	)
+}
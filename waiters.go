@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/go-github/v55/github"
+	"github.com/hashicorp/go-multierror"
+)
+
+var (
+	wakeSuffix = "wake"
+)
+
+const (
+	notifyComment = "comment"
+	notifyRelabel = "relabel"
+	notifyNone    = "none"
+)
+
+// waiter is a PR whose request for the lock was refused, stored alongside the lock until the PR obtains the lock or
+// stops requesting it
+type waiter struct {
+	HTMLURL     string    `json:"html_url"`
+	Author      string    `json:"author"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// records returns the store holding records about the lock, unwrapping lockers that manage several underlying locks
+func (lm *LabelMutex) records() (recordStore, bool) {
+	switch locker := lm.uriLocker.(type) {
+	case *sharedLocker:
+		return locker.records, true
+	case recordStore:
+		return locker, true
+	case *slotLocker:
+		records, ok := locker.slots[0].(recordStore)
+		return records, ok
+	case *groupLocker:
+		records, ok := locker.members[0].locker.(recordStore)
+		return records, ok
+	}
+	return nil, false
+}
+
+func (lm *LabelMutex) waiterKey(htmlURL string) string {
+	return fmt.Sprintf("%s.waiters.%x", lm.lock, sha1.Sum([]byte(htmlURL)))
+}
+
+// addWaiter records that the PR is waiting on the lock, keeping its place if it was already waiting
+func (lm *LabelMutex) addWaiter() error {
+	records, ok := lm.records()
+	// holders that can't be commented on can't be notified
+	if !ok || lm.notify == notifyNone || lm.holder.Number() == 0 {
+		return nil
+	}
+	value, err := json.Marshal(waiter{HTMLURL: lm.holder.URL(), Author: lm.holder.Author(), RequestedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	_, err = records.CreateRecord(lm.waiterKey(lm.holder.URL()), value)
+	return err
+}
+
+// removeWaiter records that the PR is no longer waiting on the lock
+func (lm *LabelMutex) removeWaiter() error {
+	records, ok := lm.records()
+	if !ok {
+		return nil
+	}
+	return records.DeleteRecord(lm.waiterKey(lm.holder.URL()))
+}
+
+// listWaiters returns the PRs waiting on the lock in the order they started waiting
+func (lm *LabelMutex) listWaiters() ([]waiter, error) {
+	records, ok := lm.records()
+	if !ok {
+		return nil, nil
+	}
+	values, err := records.ListRecords(fmt.Sprintf("%s.waiters.", lm.lock))
+	if err != nil {
+		return nil, err
+	}
+	waiters := []waiter{}
+	for key, value := range values {
+		var w waiter
+		if err := json.Unmarshal(value, &w); err != nil {
+			lm.logger().Warn("Ignoring unreadable waiter", "key", key, "error", err)
+			continue
+		}
+		waiters = append(waiters, w)
+	}
+	sort.Slice(waiters, func(i, j int) bool {
+		return waiters[i].RequestedAt.Before(waiters[j].RequestedAt)
+	})
+	return waiters, nil
+}
+
+// wakeLabel is the label added to the PR that has waited the longest for the lock to run its workflows again. Unlike
+// removing and re-adding the label requesting the lock, adding it doesn't look like the PR stopped requesting the lock.
+func (lm *LabelMutex) wakeLabel() string {
+	return fmt.Sprintf("%s:%s", lm.label, wakeSuffix)
+}
+
+// notifyWaiters lets the PRs waiting on the lock know that it's free. With the relabel option, the PR that has waited
+// the longest is labeled with the wake label so that its workflows run again.
+func (lm *LabelMutex) notifyWaiters(releasedBy string) error {
+	if lm.notify == notifyNone {
+		return nil
+	}
+	waiters, err := lm.listWaiters()
+	if err != nil {
+		lm.logger().Warn("Couldn't list waiters", "error", err)
+		return nil
+	}
+	var resultErr *multierror.Error
+	for i, w := range waiters {
+		owner, repo, number, err := parseIssueURL(w.HTMLURL)
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+			continue
+		}
+		lm.logger().Info("Letting waiter know the lock is free", "waiter", w.HTMLURL)
+		body := fmt.Sprintf("@%s the `%s` lock was released by %s and is free to lock. Remove and re-add `%s` to request it again.", w.Author, lm.label, releasedBy, lm.label)
+		if i == 0 && lm.notify == notifyRelabel {
+			body = fmt.Sprintf("@%s the `%s` lock was released by %s. This PR has waited the longest, so `%s` was added to request it again.", w.Author, lm.label, releasedBy, lm.wakeLabel())
+		}
+		_, _, err = lm.issuesClient.CreateComment(lm.context, owner, repo, number, &github.IssueComment{Body: github.String(body)})
+		if err != nil {
+			resultErr = multierror.Append(resultErr, err)
+		}
+		if i == 0 && lm.notify == notifyRelabel {
+			_, _, err = lm.issuesClient.AddLabelsToIssue(lm.context, owner, repo, number, []string{lm.wakeLabel()})
+			if err != nil {
+				resultErr = multierror.Append(resultErr, err)
+			}
+		}
+	}
+	lm.notified = len(waiters)
+	return resultErr.ErrorOrNil()
+}
+
+// loadWaiters reads the PRs waiting on the lock for the job summary
+func (lm *LabelMutex) loadWaiters() {
+	if lm.notify == notifyNone {
+		return
+	}
+	waiters, err := lm.listWaiters()
+	if err != nil {
+		lm.logger().Warn("Couldn't list waiters", "error", err)
+		return
+	}
+	lm.waiters = waiters
+}